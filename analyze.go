@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/twotwotwo/histzip/lrcompress"
+)
+
+// histzip analyze estimates how much repeated content the input has at various
+// distances, to help pick -hist. It fingerprints every 64-byte window with a
+// rolling hash, samples the windows whose fingerprint ends in anaSampleBits zero
+// bits (so the same content is always sampled), and looks each sample up in a
+// table of where it was last seen. Each repeat found stands for 1<<anaSampleBits
+// bytes of duplicated content. The table forgets old samples when it fills up,
+// so long distances are undercounted on big inputs.
+
+const anaWindow = 64          // bytes fingerprinted, the compressor's minimum match
+const anaSampleBits = 6       // sample 1 in 64 windows
+const anaTableBits = 22       // table slots; 4M samples covers 256 MB of input
+const anaBase = 0x100000001b3 // rolling hash multiplier (FNV-1's prime)
+
+// distances reported on, as log2 bytes; the last is as far as we look
+var anaDistBits = []uint{20, 22, 24, 26, 28}
+
+type anaSlot struct {
+	pos   int64
+	check uint32 // more fingerprint bits, to rule out most collisions
+}
+
+// Mixes the rolling hash's bits (the splitmix64 finalizer), since the high bits of
+// a polynomial hash mod 2^64 depend on more input bytes than the low ones.
+func anaMix(z uint64) uint64 {
+	z = (z ^ z>>30) * 0xBF58476D1CE4E5B9
+	z = (z ^ z>>27) * 0x94D049BB133111EB
+	return z ^ z>>31
+}
+
+// Runs histzip analyze on the named files (or stdin, for none or "-").
+func runAnalyze(args []string) error {
+	if len(args) == 0 {
+		args = []string{"-"}
+	}
+	for _, name := range args {
+		in := os.Stdin
+		if name != "-" {
+			var err error
+			if in, err = os.Open(name); err != nil {
+				return err
+			}
+		}
+		err := analyze(name, bufio.NewReaderSize(in, 1<<20), os.Stdout)
+		if in != os.Stdin {
+			in.Close() // now, not at return, so many files don't run out of descriptors
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Analyzes r and writes a report to w.
+func analyze(name string, r io.ByteReader, w io.Writer) error {
+	var pow uint64 = 1 // anaBase**anaWindow, to take a byte back out of the hash
+	for i := 0; i < anaWindow; i++ {
+		pow *= anaBase
+	}
+	table := make([]anaSlot, 1<<anaTableBits)
+	found := make([]int64, len(anaDistBits)+1) // samples repeated within each distance, then farther
+	var window [anaWindow]byte
+	var h uint64
+	var pos int64
+	for ; ; pos++ {
+		b, err := r.ReadByte()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		i := pos % anaWindow
+		h = h*anaBase + uint64(b) - pow*uint64(window[i])
+		window[i] = b
+		if pos < anaWindow-1 {
+			continue
+		}
+		m := anaMix(h)
+		if m&(1<<anaSampleBits-1) != 0 {
+			continue
+		}
+		slot := &table[m>>(64-anaTableBits)]
+		check := uint32(m >> anaSampleBits)
+		if slot.check == check && slot.pos > 0 {
+			dist := pos - slot.pos
+			j := 0
+			for j < len(anaDistBits) && dist > int64(1)<<anaDistBits[j] {
+				j++
+			}
+			found[j]++
+		}
+		slot.pos, slot.check = pos, check
+	}
+
+	// report
+	fmt.Fprintf(w, "%s: %d bytes, sampling 1 in %d %d-byte windows\n", name, pos, 1<<anaSampleBits, anaWindow)
+	if pos == 0 {
+		return nil
+	}
+	fmt.Fprintln(w, "  repeated content found within:")
+	var within []int64 // cumulative bytes repeated within each distance
+	total := int64(0)
+	for j, bits := range anaDistBits {
+		total += found[j] << anaSampleBits
+		if total > pos {
+			total = pos
+		}
+		within = append(within, total)
+		fmt.Fprintf(w, "    %8s %14d bytes (%.1f%%)\n", sizeName(int(bits)), total, percent(total, pos))
+	}
+	if farther := found[len(anaDistBits)] << anaSampleBits; farther > 0 {
+		fmt.Fprintf(w, "  farther back: %d bytes (%.1f%%); -far or -mmap can reach those\n", farther, percent(farther, pos))
+	}
+
+	// recommend the smallest history getting nearly everything the biggest does
+	best := within[len(within)-1]
+	rec := anaDistBits[len(anaDistBits)-1]
+	for j, bits := range anaDistBits {
+		if within[j] >= best-best/20 {
+			rec = bits
+			break
+		}
+	}
+	if rec < lrcompress.CompHistBits {
+		rec = lrcompress.CompHistBits // the default is plenty cheap
+	}
+	fmt.Fprintf(w, "  recommended: -hist %d (%s of history, %.1f%% of input repeated within it)\n", rec, sizeName(int(rec)), percent(within[anaIndex(rec)], pos))
+	fmt.Fprintf(w, "  decompression needs about %s of RAM, compression about %d MB", sizeName(int(rec)), 3<<rec>>21)
+	if rec > decompressMaxHistBits {
+		fmt.Fprintf(w, "; decompress with -maxhist %d", rec)
+	}
+	fmt.Fprintln(w)
+	return nil
+}
+
+// Index in anaDistBits of the smallest distance covering 1<<bits.
+func anaIndex(bits uint) int {
+	for j, b := range anaDistBits {
+		if b >= bits {
+			return j
+		}
+	}
+	return len(anaDistBits) - 1
+}
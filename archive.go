@@ -0,0 +1,480 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/twotwotwo/histzip/framing"
+)
+
+// -a packs files and directories into one histzip archive (see format.md): the
+// header has the archive record, and the data is each file's entry then its
+// content, all compressed as one stream so files share history and near-copies of
+// each other compress well. -x extracts archives and -l lists them.
+
+// entry types in an archive
+const (
+	entryEnd     = 0
+	entryFile    = 1
+	entryDir     = 2
+	entrySymlink = 3 // content is the link's target
+)
+
+const maxLinkLen = 1 << 16 // longest symlink target we'll read
+
+// One file, directory, or symlink in an archive.
+type archiveEntry struct {
+	typ   byte
+	path  string      // slash-separated, relative
+	perm  os.FileMode // permission bits
+	mtime time.Time
+	size  int64  // of the content
+	src   string // when archiving, where to read it
+}
+
+// Writes e's entry (not its content) to w.
+func (e *archiveEntry) writeTo(w *bufio.Writer) error {
+	var buf [binary.MaxVarintLen64]byte
+	w.WriteByte(e.typ)
+	if e.typ == entryEnd {
+		return nil
+	}
+	w.Write(buf[:binary.PutUvarint(buf[:], uint64(len(e.path)))])
+	w.WriteString(e.path)
+	w.Write(buf[:binary.PutUvarint(buf[:], uint64(e.perm))])
+	w.Write(buf[:binary.PutVarint(buf[:], e.mtime.UnixNano())])
+	_, err := w.Write(buf[:binary.PutUvarint(buf[:], uint64(e.size))])
+	return err
+}
+
+var errBadEntry = errors.New("bad archive entry")
+
+// Reads an entry from r, returning errBadEntry if it's malformed or its path is
+// one we wouldn't write (absolute, or going up with ..).
+func readEntry(r *bufio.Reader) (*archiveEntry, error) {
+	typ, err := r.ReadByte()
+	if err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return nil, err
+	}
+	e := &archiveEntry{typ: typ}
+	if typ == entryEnd {
+		return e, nil
+	} else if typ > entrySymlink {
+		return nil, errBadEntry
+	}
+	pathLen, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, noEOF(err)
+	} else if pathLen == 0 || pathLen > 1<<16 {
+		return nil, errBadEntry
+	}
+	path := make([]byte, pathLen)
+	if _, err = io.ReadFull(r, path); err != nil {
+		return nil, noEOF(err)
+	}
+	perm, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, noEOF(err)
+	}
+	mtime, err := binary.ReadVarint(r)
+	if err != nil {
+		return nil, noEOF(err)
+	}
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, noEOF(err)
+	}
+	e.path, e.perm, e.mtime, e.size = string(path), os.FileMode(perm)&os.ModePerm, time.Unix(0, mtime), int64(size)
+	if !safePath(e.path) || size > 1<<62 || (typ == entryDir && size != 0) || (typ == entrySymlink && size > maxLinkLen) {
+		return nil, errBadEntry
+	}
+	return e, nil
+}
+
+// Whether p is a relative, slash-separated path that stays inside the directory
+// it's extracted to.
+func safePath(p string) bool {
+	if p == "" || strings.HasPrefix(p, "/") || strings.Contains(p, "\\") || filepath.VolumeName(p) != "" {
+		return false
+	}
+	for _, part := range strings.Split(p, "/") {
+		if part == "" || part == "." || part == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// Lists the entries for the files and directories named, in the order they'll be
+// archived. skip is the archive itself, if it's a file, so we don't archive it.
+func collectEntries(names []string, skip os.FileInfo) ([]*archiveEntry, error) {
+	var entries []*archiveEntry
+	for _, name := range names {
+		err := filepath.Walk(name, func(src string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			} else if skip != nil && os.SameFile(info, skip) {
+				return nil
+			}
+			path := filepath.ToSlash(filepath.Clean(src))
+			path = strings.TrimLeft(path[len(filepath.VolumeName(path)):], "/")
+			if path == "" || path == "." {
+				return nil // the root of `-a out.hza .` or `/`
+			} else if !safePath(path) {
+				return fmt.Errorf("%s: won't archive paths with ..", src)
+			}
+			e := &archiveEntry{path: path, perm: info.Mode().Perm(), mtime: info.ModTime(), src: src}
+			switch mode := info.Mode(); {
+			case mode.IsRegular():
+				e.typ, e.size = entryFile, info.Size()
+			case mode.IsDir():
+				e.typ = entryDir
+			case mode&os.ModeSymlink != 0:
+				target, err := os.Readlink(src)
+				if err != nil {
+					return err
+				}
+				e.typ, e.size = entrySymlink, int64(len(target))
+			default:
+				fmt.Fprintf(os.Stderr, "histzip: skipping %s: not a file, directory, or symlink\n", src)
+				return nil
+			}
+			if *noNameFlag {
+				e.mtime = time.Unix(0, 0)
+			}
+			entries = append(entries, e)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// Writes the uncompressed archive stream for entries to w.
+func writeArchive(w io.Writer, entries []*archiveEntry) error {
+	bw := bufio.NewWriter(w)
+	for _, e := range entries {
+		if err := e.writeTo(bw); err != nil {
+			return err
+		}
+		switch e.typ {
+		case entryFile:
+			f, err := os.Open(e.src)
+			if err != nil {
+				return err
+			}
+			n, err := io.CopyN(bw, f, e.size) // if it grew, we take what we said we would
+			f.Close()
+			if err == io.EOF {
+				return fmt.Errorf("%s: shrank from %d to %d bytes while archiving", e.src, e.size, n)
+			} else if err != nil {
+				return err
+			}
+		case entrySymlink:
+			target, err := os.Readlink(e.src)
+			if err != nil {
+				return err
+			} else if int64(len(target)) != e.size {
+				return fmt.Errorf("%s: changed while archiving", e.src)
+			}
+			bw.WriteString(target)
+		}
+	}
+	if err := (&archiveEntry{typ: entryEnd}).writeTo(bw); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// Runs -a: archives the files and directories named to outName ("-" for stdout).
+func runArchive(outName string, names []string) (err error) {
+	out, outFile := io.Writer(os.Stdout), (*os.File)(nil)
+	var skip os.FileInfo
+	if outName != "-" {
+		if outFile, err = createOutput(outName, 0666); err != nil {
+			return err
+		}
+		defer outFile.Close()
+		if skip, err = outFile.Stat(); err != nil {
+			return err
+		}
+		out = outFile
+	}
+	entries, err := collectEntries(names, skip)
+	if err != nil {
+		return err
+	}
+
+	// feed the archive stream to compress through a pipe
+	pr, pw := io.Pipe()
+	defer pr.Close() // unblocks writeArchive if we fail
+	go func() {
+		pw.CloseWithError(writeArchive(pw, entries))
+	}()
+	var src io.Reader = pr
+	if *progressFlag {
+		var size int64
+		for _, e := range entries {
+			size += e.size
+		}
+		prog = startProgress(size)
+		defer func() {
+			prog.finish()
+			prog = nil
+		}()
+		src, out = progressReader{pr}, progressWriter{out}
+	}
+	h := &framing.Header{HistBits: *histFlag, Index: *indexFlag, Checksum: checksumID, Creator: Creator, Coder: framing.CoderArchive}
+	if err = compress(nil, bufio.NewReader(src), out, h); err != nil {
+		return err
+	}
+	if outFile != nil {
+		if err = outFile.Close(); err != nil {
+			return err
+		}
+	}
+	partialOutput = ""
+	return nil
+}
+
+// Runs -x or -l on the archive inName ("-" for stdin): extracts it under -o's
+// directory (or the current one), or lists it to stdout.
+func runExtract(inName string, list bool) error {
+	in := os.Stdin
+	if inName != "-" {
+		f, err := os.Open(inName)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	cr := &countingReader{r: in} // for the compressed size in -l's total
+	var src io.Reader = cr
+	if *progressFlag && !list {
+		var size int64
+		if info, err := in.Stat(); err == nil && info.Mode().IsRegular() {
+			size = info.Size()
+		}
+		prog = startProgress(size)
+		defer func() {
+			prog.finish()
+			prog = nil
+		}()
+		src = progressReader{cr}
+	}
+	br := bufio.NewReader(src)
+	h, err := readHeader(br)
+	if err == framing.ErrNotHistzip || (err == nil && h.Coder&framing.CoderArchive == 0) {
+		return errors.New("not a histzip archive")
+	} else if err != nil {
+		return err
+	}
+
+	// decompress through a pipe and read entries from the other end
+	pr, pw := io.Pipe()
+	defer pr.Close() // unblocks decompress if we fail
+	go func() {
+		var w io.Writer = pw
+		if prog != nil {
+			w = progressWriter{pw}
+		}
+		pw.CloseWithError(decompress(in, br, h, w))
+	}()
+	ar := bufio.NewReader(pr)
+	dest := *outFlag
+	if dest == "" {
+		dest = "."
+	} else if !list {
+		if err := os.MkdirAll(dest, 0777); err != nil {
+			return err
+		}
+	}
+	var dirs []*archiveEntry // to fix up after their contents are written
+	var files, total int64
+	for {
+		e, err := readEntry(ar)
+		if err != nil {
+			return err
+		} else if e.typ == entryEnd {
+			break
+		}
+		if list {
+			err = listEntry(e, ar)
+		} else {
+			err = extractEntry(e, ar, dest)
+		}
+		if err != nil {
+			return err
+		}
+		if e.typ == entryDir {
+			dirs = append(dirs, e)
+		} else {
+			files, total = files+1, total+e.size
+		}
+	}
+	// reading to the end checks the last block's checksum
+	if n, err := io.Copy(ioutil.Discard, ar); err != nil {
+		return err
+	} else if n > 0 {
+		return errors.New("data after end of archive")
+	}
+
+	if list {
+		fmt.Printf("%d files, %d directories, %d bytes, compressed to %d (%.1f%%)\n", files, len(dirs), total, cr.n, percent(cr.n, total))
+		return nil
+	}
+	// innermost first, so setting a parent's time comes after changing its children
+	for i := len(dirs) - 1; i >= 0; i-- {
+		e := dirs[i]
+		path := filepath.Join(dest, filepath.FromSlash(e.path))
+		if err := os.Chmod(path, e.perm); err != nil {
+			return err
+		}
+		if !*noNameFlag {
+			if err := os.Chtimes(path, e.mtime, e.mtime); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Prints e like ls -l, skipping its content in r.
+func listEntry(e *archiveEntry, r *bufio.Reader) error {
+	mode := e.perm
+	switch e.typ {
+	case entryDir:
+		mode |= os.ModeDir
+	case entrySymlink:
+		mode |= os.ModeSymlink
+	}
+	line := fmt.Sprintf("%v %12d %s %s", mode, e.size, e.mtime.Format("2006-01-02 15:04"), e.path)
+	if e.typ == entrySymlink {
+		target := make([]byte, e.size)
+		if _, err := io.ReadFull(r, target); err != nil {
+			return noEOF(err)
+		}
+		line += " -> " + string(target)
+	} else if _, err := io.CopyN(ioutil.Discard, r, e.size); err != nil {
+		return noEOF(err)
+	}
+	fmt.Println(line)
+	return nil
+}
+
+// Writes e under dest, reading its content from r. Directories get their final
+// mode and time later.
+func extractEntry(e *archiveEntry, r *bufio.Reader, dest string) error {
+	path := filepath.Join(dest, filepath.FromSlash(e.path))
+	if err := checkParents(dest, e.path); err != nil {
+		return err
+	}
+	// don't follow a symlink already there; -f replaces it
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		if !*forceFlag {
+			return errors.New(path + " exists; use -f to overwrite")
+		} else if err = os.Remove(path); err != nil {
+			return err
+		}
+	}
+	switch e.typ {
+	case entryDir:
+		if err := os.Mkdir(path, 0700|e.perm); err != nil && !os.IsExist(err) {
+			return err
+		} else if info, err := os.Stat(path); err != nil || !info.IsDir() {
+			return fmt.Errorf("%s exists and isn't a directory", path)
+		}
+	case entrySymlink:
+		target := make([]byte, e.size)
+		if _, err := io.ReadFull(r, target); err != nil {
+			return noEOF(err)
+		}
+		if *forceFlag {
+			os.Remove(path)
+		}
+		if err := os.Symlink(string(target), path); os.IsExist(err) {
+			return errors.New(path + " exists; use -f to overwrite")
+		} else if err != nil {
+			return err
+		}
+	case entryFile:
+		f, err := createOutput(path, e.perm)
+		if err != nil {
+			return err
+		}
+		bw := bufio.NewWriter(f)
+		_, err = io.CopyN(bw, r, e.size)
+		if err == nil {
+			err = bw.Flush()
+		}
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil && !*noNameFlag {
+			err = os.Chtimes(path, e.mtime, e.mtime)
+		}
+		if err != nil {
+			return noEOF(err)
+		}
+		partialOutput = ""
+	}
+	return nil
+}
+
+// Makes the directories above path (slash-separated, under dest) as needed, and
+// makes sure none is a symlink, which could point outside dest.
+func checkParents(dest, path string) error {
+	parts := strings.Split(path, "/")
+	dir := dest
+	for _, part := range parts[:len(parts)-1] {
+		dir = filepath.Join(dir, part)
+		info, err := os.Lstat(dir)
+		if os.IsNotExist(err) {
+			if err = os.Mkdir(dir, 0777); err != nil {
+				return err
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("%s: won't extract through symlink %s", path, dir)
+		} else if !info.IsDir() {
+			return fmt.Errorf("%s: %s isn't a directory", path, dir)
+		}
+	}
+	return nil
+}
+
+// Content ending early means the archive's truncated, not that all is well.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Counts what's read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+
+	"github.com/twotwotwo/histzip/framing"
+	"github.com/twotwotwo/histzip/lrcompress"
+	"github.com/vova616/xxhash"
+)
+
+// histzip diff and patch compress a file using another as dictionary content (see
+// lrcompress/format.md), making a binary delta in the Bentley-McIlroy style. The
+// header's base record has the base's length and checksum so patch can refuse the
+// wrong one. The history has to cover the base and the new file for every part of
+// the base to be usable, so we size it to fit, up to decompressMaxHistBits.
+
+const loadChunk = 1 << 20
+
+// Loads the base into c and d (either can be nil) as dictionary content.
+func loadBase(base io.Reader, c *lrcompress.Compressor, d *lrcompress.Decompressor) error {
+	buf := make([]byte, loadChunk)
+	for {
+		n, err := io.ReadFull(base, buf)
+		if n > 0 {
+			if c != nil {
+				c.Load(buf[:n])
+			}
+			if d != nil {
+				d.Load(buf[:n])
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// Returns the base record's value for the file f.
+func baseRecord(f *os.File) ([]byte, error) {
+	if _, err := f.Seek(0, 0); err != nil {
+		return nil, err
+	}
+	h := xxhash.New(0)
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = f.Seek(0, 0); err != nil {
+		return nil, err
+	}
+	rec := make([]byte, 8, 12)
+	binary.BigEndian.PutUint64(rec, uint64(n))
+	return h.Sum(rec), nil
+}
+
+// Smallest history that holds size bytes, within what we can read.
+func bitsFor(size int64) uint {
+	bits := uint(lrcompress.CompHistBits)
+	for bits < decompressMaxHistBits && int64(1)<<bits < size {
+		bits++
+	}
+	return bits
+}
+
+// Runs histzip diff or histzip patch with the given args.
+func runDelta(cmd string, args []string) (err error) {
+	if cmd == "diff" && len(args) != 2 {
+		exitWithUsage("diff takes an old and a new file")
+	} else if cmd == "patch" && (len(args) < 1 || len(args) > 2) {
+		exitWithUsage("patch takes an old file and optionally a delta (else stdin)")
+	} else if *zipFlag {
+		exitWithUsage("can't use -z with diff or patch")
+	}
+	base, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer base.Close()
+	baseRec, err := baseRecord(base)
+	if err != nil {
+		return err
+	}
+	in := os.Stdin
+	if len(args) > 1 && args[1] != "-" {
+		if in, err = os.Open(args[1]); err != nil {
+			return err
+		}
+		defer in.Close()
+	}
+
+	var out io.Writer = os.Stdout
+	var outFile *os.File
+	if *outFlag != "" && *outFlag != "-" {
+		if outFile, err = createOutput(*outFlag, 0666); err != nil {
+			return err
+		}
+		out = outFile
+	}
+	if cmd == "diff" {
+		err = diff(base, baseRec, in, out)
+	} else {
+		err = patch(base, baseRec, in, out)
+	}
+	if outFile != nil {
+		if closeErr := outFile.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err == nil {
+		partialOutput = ""
+	}
+	return err
+}
+
+// Writes a delta that turns base into in.
+func diff(base *os.File, baseRec []byte, in *os.File, w io.Writer) error {
+	size := int64(binary.BigEndian.Uint64(baseRec))
+	if info, err := in.Stat(); err == nil && info.Mode().IsRegular() {
+		size += info.Size()
+	} else {
+		size *= 2 // guess
+	}
+	bits := bitsFor(size)
+
+	h := &framing.Header{HistBits: bits, Base: baseRec, Checksum: checksumID, Creator: Creator}
+	if *shortFlag {
+		h.Coder |= framing.CoderShort
+	}
+	if *syncFlag {
+		h.Coder |= framing.CoderSync | framing.CoderHeaders
+	}
+	if _, err := h.WriteTo(w); err != nil {
+		return errors.New("could not write header")
+	}
+	_, err := compressStream(bufio.NewReader(in), w, bits, base)
+	return err
+}
+
+// Applies the delta in in to base.
+func patch(base *os.File, baseRec []byte, in *os.File, w io.Writer) error {
+	br := bufio.NewReader(in)
+	h, err := readHeader(br)
+	if err != nil {
+		return err
+	} else if h.Base == nil {
+		return errors.New("input isn't a delta")
+	} else if !bytes.Equal(h.Base, baseRec) {
+		return errors.New("delta was made against a different base file")
+	} else if h.Coder&^knownCoders != 0 {
+		return errors.New("file uses an unknown second-stage coder; upgrade, please")
+	} else if h.Coder&^(framing.CoderShort|framing.CoderSync|framing.CoderHeaders) != 0 {
+		return errors.New("delta uses a second-stage coder patch can't read")
+	}
+	d, err := lrcompress.NewDecompressorOptions(br, h.HistBits, newHash(h.Checksum), true, limits(h))
+	if err != nil {
+		return err
+	}
+	if err = loadBase(base, nil, d); err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	if _, err = d.WriteTo(bw); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/twotwotwo/histzip/framing"
+	"github.com/twotwotwo/histzip/lrcompress"
+)
+
+// histzip dump prints the lrcompress instructions in a compressed file, one per
+// line, for debugging poor ratios and corrupt files. Offsets count from the start
+// of the lrcompress data (after undoing any -z); positions count uncompressed bytes,
+// including a delta's base. For -far files, it's the far layer that's described.
+
+// an instruction as -json prints it
+type dumpInstr struct {
+	Kind       string      `json:"kind"`
+	Offset     int64       `json:"offset"`
+	Pos        int64       `json:"pos"`
+	Block      int64       `json:"block"`
+	Length     int64       `json:"length"`
+	CursorMove int64       `json:"cursorMove,omitempty"`
+	From       *int64      `json:"from,omitempty"`
+	Tokens     []dumpToken `json:"tokens,omitempty"`
+	Checksum   string      `json:"checksum,omitempty"`
+}
+
+type dumpToken struct {
+	Pos      int64 `json:"pos"`
+	Length   int64 `json:"length"`
+	Distance int64 `json:"distance,omitempty"`
+}
+
+// Runs histzip dump with the given args: a compressed file (- for stdin) and, if
+// it's a delta, its base.
+func runDump(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		exitWithUsage("dump takes a compressed file (- for stdin) and, for a delta, its base")
+	}
+	in := os.Stdin
+	if args[0] != "-" {
+		var err error
+		if in, err = os.Open(args[0]); err != nil {
+			return err
+		}
+		defer in.Close()
+	}
+	br := bufio.NewReader(in)
+	h, err := readHeader(br)
+	if err != nil {
+		return err
+	} else if h.Coder&^knownCoders != 0 {
+		return errors.New("file uses an unknown second-stage coder; upgrade, please")
+	} else if (h.Base != nil) != (len(args) == 2) {
+		return errors.New("dump needs a delta's base file, and only for a delta")
+	}
+	var r io.Reader = br
+	if h.Coder&framing.CoderFlate != 0 {
+		fr := flate.NewReader(br)
+		defer fr.Close()
+		r = fr
+	}
+
+	// make a decompressor to run the instructions through
+	var d *lrcompress.Decompressor
+	if h.Coder&framing.CoderFlat != 0 {
+		if *maxOutFlag > 0 && h.SizeHint > *maxOutFlag {
+			return lrcompress.ErrLimitExceeded
+		}
+		tmp, err := ioutil.TempFile("", "histzip")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+		if err = tmp.Truncate(h.SizeHint); err != nil {
+			return err
+		}
+		out, err := mapFile(tmp, h.SizeHint, true)
+		if err != nil {
+			return err
+		}
+		defer unmapFile(tmp, out, true)
+		d = lrcompress.NewFlatDecompressor(r, out, newHash(h.Checksum), limits(h))
+	} else if d, err = lrcompress.NewDecompressorOptions(r, h.HistBits, newHash(h.Checksum), true, limits(h)); err != nil {
+		return err
+	}
+	if h.Base != nil {
+		base, err := os.Open(args[1])
+		if err != nil {
+			return err
+		}
+		defer base.Close()
+		if rec, err := baseRecord(base); err != nil {
+			return err
+		} else if !bytes.Equal(rec, h.Base) {
+			return errors.New("delta was made against a different base file")
+		} else if err = loadBase(base, nil, d); err != nil {
+			return err
+		}
+	}
+
+	bw := bufio.NewWriter(os.Stdout)
+	defer bw.Flush()
+	enc := json.NewEncoder(bw)
+	if !*jsonFlag {
+		fmt.Fprintf(bw, "# histBits %d, version %d.%d, coder %d, checksum %d\n", h.HistBits, h.VerMajor, h.VerMinor, h.Coder, h.Checksum)
+		fmt.Fprintf(bw, "# %10s %12s  %s\n", "offset", "pos", "instruction")
+	}
+	x := lrcompress.NewInstrReader(d)
+	for {
+		i, err := x.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			bw.Flush()
+			return err
+		}
+		if *jsonFlag {
+			err = enc.Encode(jsonInstr(i))
+		} else {
+			err = printInstr(bw, i)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func jsonInstr(i lrcompress.Instr) dumpInstr {
+	j := dumpInstr{Kind: i.Kind.String(), Offset: i.Offset, Pos: i.Pos, Block: i.Block, Length: i.Length}
+	switch i.Kind {
+	case lrcompress.Copy:
+		j.CursorMove, j.From = i.CursorMove, &i.From
+	case lrcompress.EndOfBlock:
+		j.Checksum = hex.EncodeToString(i.Checksum)
+	}
+	for _, t := range i.Tokens {
+		j.Tokens = append(j.Tokens, dumpToken(t))
+	}
+	return j
+}
+
+func printInstr(w io.Writer, i lrcompress.Instr) (err error) {
+	switch i.Kind {
+	case lrcompress.Literal:
+		_, err = fmt.Fprintf(w, "%12d %12d  literal %d\n", i.Offset, i.Pos, i.Length)
+	case lrcompress.Copy:
+		_, err = fmt.Fprintf(w, "%12d %12d  copy %d from %d (%d back, cursorMove %d)\n", i.Offset, i.Pos, i.Length, i.From, i.Pos-i.From, i.CursorMove)
+	case lrcompress.EndOfBlock:
+		sum := ""
+		if len(i.Checksum) > 0 {
+			sum = ", checksum " + hex.EncodeToString(i.Checksum)
+		}
+		if i.Length == 0 {
+			_, err = fmt.Fprintf(w, "%12d %12d  end of stream%s\n", i.Offset, i.Pos, sum)
+		} else {
+			_, err = fmt.Fprintf(w, "%12d %12d  end of block %d: %d bytes%s\n", i.Offset, i.Pos, i.Block, i.Length, sum)
+		}
+	}
+	for _, t := range i.Tokens {
+		if err != nil {
+			return
+		} else if t.Distance == 0 {
+			_, err = fmt.Fprintf(w, "%12s %12d    run %d\n", "", t.Pos, t.Length)
+		} else {
+			_, err = fmt.Fprintf(w, "%12s %12d    short %d from %d back\n", "", t.Pos, t.Length, t.Distance)
+		}
+	}
+	return
+}
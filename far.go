@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/twotwotwo/histzip/framing"
+	"github.com/twotwotwo/histzip/lrcompress"
+)
+
+// With -far, a pre-pass in the style of rzip finds repeats too far apart for the
+// history: it cuts the whole input into content-defined chunks, remembers where
+// each chunk was last written out literally, and replaces a chunk whose last copy
+// is out of the compressor's reach with a reference to it. The result (the "far
+// layer", see format.md) is what lrcompress compresses. The decompressor resolves
+// references by reading back its own output, so it needs to write to a file.
+
+// chunk sizes: cut where the gear hash's low farAvgBits bits are 0, within limits
+const farMinChunk, farAvgBits, farMaxChunk = 2 << 10, 13, 64 << 10
+
+const farMaxLiteral = 1 << 20 // longest literal record we write
+
+// random values for the gear hash, from splitmix64
+var farGear = func() (g [256]uint64) {
+	x := uint64(0x2545F4914F6CDD1D)
+	for i := range g {
+		x += 0x9E3779B97F4A7C15
+		z := x
+		z = (z ^ z>>30) * 0xBF58476D1CE4E5B9
+		z = (z ^ z>>27) * 0x94D049BB133111EB
+		g[i] = z ^ z>>31
+	}
+	return
+}()
+
+// Where a chunk's content was last written out literally.
+type farSeen struct {
+	pos  int64 // in the input
+	lpos int64 // in the far layer, which is what the compressor's history covers
+}
+
+// Writes the far layer for the input to w. br reads the input from its start;
+// in has the same content, for checking candidate repeats. bits is the history the
+// far layer will be compressed with, and sumID the checksum to put at the end.
+func farPass(in io.ReaderAt, br io.Reader, w io.Writer, bits uint, sumID byte) error {
+	bw := bufio.NewWriter(w)
+	var lpos int64     // bytes of far layer written
+	var pos int64      // input bytes handled
+	var refSrc int64   // pending reference's source...
+	var refLen int64   // ...and length
+	var literal []byte // pending literal
+	var varint [binary.MaxVarintLen64]byte
+	putUvarint := func(i uint64) {
+		n := binary.PutUvarint(varint[:], i)
+		bw.Write(varint[:n])
+		lpos += int64(n)
+	}
+	flushLiteral := func() {
+		if len(literal) > 0 {
+			putUvarint(uint64(len(literal)) << 1)
+			bw.Write(literal)
+			lpos += int64(len(literal))
+			literal = literal[:0]
+		}
+	}
+	flushRef := func() {
+		if refLen > 0 {
+			putUvarint(uint64(refLen)<<1 | 1)
+			putUvarint(uint64(refSrc))
+			refLen = 0
+		}
+	}
+
+	sum := newHash(sumID)
+	chunkSum, _ := framing.NewChecksum(framing.ChecksumXXHash64)
+	seen := map[uint64]farSeen{}
+	far := int64(3) << (bits - 2) // leave nearer repeats to the compressor
+	src := bufio.NewReaderSize(br, farMaxChunk)
+	chunk := make([]byte, 0, farMaxChunk)
+	check := make([]byte, farMaxChunk)
+	for {
+		// find the next chunk
+		chunk = chunk[:0]
+		var g uint64
+		for len(chunk) < farMaxChunk {
+			b, err := src.ReadByte()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
+			chunk = append(chunk, b)
+			g = g<<1 + farGear[b]
+			if len(chunk) >= farMinChunk && g&(1<<farAvgBits-1) == 0 {
+				break
+			}
+		}
+		if len(chunk) == 0 {
+			break
+		}
+		if sum != nil {
+			sum.Write(chunk)
+		}
+
+		// reference an earlier copy if the compressor can't see it, else write it
+		chunkSum.Reset()
+		chunkSum.Write(chunk)
+		key := chunkSum.(hash.Hash64).Sum64()
+		prev, ok := seen[key]
+		here := lpos + int64(len(literal))
+		if ok && here-prev.lpos > far {
+			if _, err := in.ReadAt(check[:len(chunk)], prev.pos); err != nil {
+				return err
+			}
+			ok = bytes.Equal(check[:len(chunk)], chunk)
+		} else {
+			ok = false
+		}
+		if ok {
+			flushLiteral()
+			if refLen > 0 && refSrc+refLen != prev.pos {
+				flushRef()
+			}
+			if refLen == 0 {
+				refSrc = prev.pos
+			}
+			refLen += int64(len(chunk))
+		} else {
+			flushRef()
+			seen[key] = farSeen{pos: pos, lpos: here}
+			literal = append(literal, chunk...)
+			if len(literal) >= farMaxLiteral {
+				flushLiteral()
+			}
+		}
+		pos += int64(len(chunk))
+	}
+	flushLiteral()
+	flushRef()
+	putUvarint(0)
+	if sum != nil {
+		bw.Write(sum.Sum(nil))
+	}
+	return bw.Flush()
+}
+
+var errFarCorrupt = errors.New("far reference is corrupt")
+
+// Reads the far layer from r and writes the output it describes to out, which has
+// to be open for reading as well, starting at its beginning.
+func farUndo(r *bufio.Reader, out *os.File, sumID byte) error {
+	bw := bufio.NewWriterSize(out, 1<<20)
+	sum := newHash(sumID)
+	var w io.Writer = bw
+	if sum != nil {
+		w = io.MultiWriter(bw, sum)
+	}
+	var pos int64
+	buf := make([]byte, 1<<20)
+	for {
+		t, err := binary.ReadUvarint(r)
+		if err != nil {
+			return errFarCorrupt
+		}
+		n := int64(t >> 1)
+		if t != 0 && n <= 0 {
+			return errFarCorrupt
+		} else if *maxOutFlag > 0 && pos+n > *maxOutFlag {
+			return lrcompress.ErrLimitExceeded
+		}
+		if t == 0 { // end, then checksum
+			if err = bw.Flush(); err != nil {
+				return err
+			} else if sum == nil {
+				return nil
+			}
+			want := make([]byte, sum.Size())
+			if _, err = io.ReadFull(r, want); err != nil {
+				return errFarCorrupt
+			} else if !bytes.Equal(want, sum.Sum(nil)) {
+				return errors.New("output checksum mismatch")
+			}
+			return nil
+		} else if t&1 == 0 { // literal
+			if _, err = io.CopyN(w, r, n); err != nil {
+				return errFarCorrupt
+			}
+			pos += n
+			prog.addOut(n)
+			continue
+		}
+		// reference to earlier output, which may overlap what it writes
+		from, err := binary.ReadUvarint(r)
+		if err != nil || int64(from) >= pos || int64(from) < 0 {
+			return errFarCorrupt
+		}
+		if err = bw.Flush(); err != nil {
+			return err
+		}
+		for src := int64(from); n > 0; {
+			l := int64(len(buf))
+			if l > n {
+				l = n
+			}
+			if l > pos-src {
+				l = pos - src
+			}
+			if _, err = out.ReadAt(buf[:l], src); err != nil {
+				return err
+			}
+			if _, err = w.Write(buf[:l]); err != nil {
+				return err
+			} else if err = bw.Flush(); err != nil {
+				return err
+			}
+			src, pos, n = src+l, pos+l, n-l
+			prog.addOut(l)
+		}
+	}
+}
+
+// Returns in as something farPass can check repeats against: in itself if it's a
+// regular file, else a temp file holding what's left in br, which is then reread.
+// The caller should call cleanup when done.
+func farInput(in *os.File, br *bufio.Reader) (ra io.ReaderAt, r io.Reader, cleanup func(), err error) {
+	if info, err := in.Stat(); err == nil && info.Mode().IsRegular() {
+		return in, br, func() {}, nil
+	}
+	tmp, err := ioutil.TempFile("", "histzip")
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	cleanup = func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}
+	if _, err = io.Copy(tmp, br); err != nil {
+		cleanup()
+		return nil, nil, nil, err
+	}
+	return tmp, io.NewSectionReader(tmp, 0, 1<<62), cleanup, nil
+}
+
+// Decompresses the far layer in r to w, going through a temp file unless w is an
+// output file we opened (for reading too).
+func farOutput(r *bufio.Reader, w io.Writer, sumID byte) error {
+	w = uncounted(w) // farUndo counts
+	if f, ok := w.(*os.File); ok && f != os.Stdout {
+		return farUndo(r, f, sumID)
+	}
+	tmp, err := ioutil.TempFile("", "histzip")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	if err = farUndo(r, tmp, sumID); err != nil {
+		return err
+	}
+	_, err = io.Copy(w, io.NewSectionReader(tmp, 0, 1<<62))
+	return err
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/twotwotwo/histzip/framing"
+	"github.com/twotwotwo/histzip/lrcompress"
+)
+
+// With -mmap, a regular input file is mapped into memory and compressed in place,
+// with everything before the current position as history (lrcompress's
+// FlatCompressor), instead of being copied through a ring. Copies can then reach
+// back to the start of the file, so decompressing maps the output file the same
+// way; see format.md.
+
+// If in is a regular file, maps it and returns the part br reads, with ok set and
+// a cleanup function to call when done. Otherwise returns ok false, and the input
+// has to be streamed as usual.
+func mapInput(in *os.File, br *bufio.Reader) (data []byte, ok bool, cleanup func(), err error) {
+	info, err := in.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		return nil, false, nil, nil
+	}
+	// br has read ahead; stdin, say, might not have started at the beginning
+	start, err := in.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, false, nil, nil
+	}
+	start -= int64(br.Buffered())
+	whole, err := mapFile(in, info.Size(), false)
+	if err != nil {
+		return nil, false, nil, err
+	}
+	return whole[start:], true, func() { unmapFile(in, whole, false) }, nil
+}
+
+// Compresses data, the mapped input, to w with a FlatCompressor, checking the
+// output against data as we go.
+func compressFlat(data []byte, w io.Writer) error {
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	bw := bufio.NewWriter(io.MultiWriter(w, pw))
+	c, err := lrcompress.NewFlatCompressor(bw, newHash(checksumID), data, compressorOptions(0))
+	if err != nil {
+		return err
+	}
+	c.OnProgress(1<<20, func(in, out int64) { prog.setIn(in) }) // data isn't read through br
+	d := lrcompress.NewFlatVerifier(pr, data, newHash(checksumID), selfTestOptions())
+
+	// go decompress and compare
+	checkErr := make(chan error, 1)
+	go func() {
+		_, err := d.WriteTo(ioutil.Discard)
+		go io.Copy(ioutil.Discard, pr) // ensure pipe drained even on err
+		checkErr <- err
+	}()
+
+	// compress
+	for {
+		n, err := c.Next(ChunkSize)
+		if err != nil {
+			return err
+		} else if n == 0 {
+			break
+		}
+		if err = c.Delimit(); err != nil {
+			return err
+		}
+		select {
+		case err = <-checkErr:
+			return fmt.Errorf("test decompression error: %v", err)
+		default:
+		}
+	}
+	if err := c.Close(); err != nil {
+		return err
+	} else if err = bw.Flush(); err != nil {
+		return err
+	}
+	pw.Close()
+	if err := <-checkErr; err != nil {
+		return fmt.Errorf("test decompression error: %v", err)
+	}
+	s := c.Stats()
+	stats.Add(&s)
+	statsHistBits = 0
+	return nil
+}
+
+// Decompresses a file compressed with -mmap from r, the lrcompress data, to w. The
+// output goes into a mapped file: w itself if it's an output file we opened (for
+// reading and writing), else a temp file that's then copied to w.
+func flatOutput(r io.Reader, w io.Writer, h *framing.Header) error {
+	if *maxOutFlag > 0 && h.SizeHint > *maxOutFlag {
+		return lrcompress.ErrLimitExceeded
+	}
+	w = uncounted(w) // output goes to the map, so d reports it
+	f, ok := w.(*os.File)
+	if !ok || f == os.Stdout {
+		tmp, err := ioutil.TempFile("", "histzip")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+		f = tmp
+	}
+	if err := f.Truncate(h.SizeHint); err != nil {
+		return err
+	}
+	out, err := mapFile(f, h.SizeHint, true)
+	if err != nil {
+		return err
+	}
+	d := lrcompress.NewFlatDecompressor(r, out, newHash(h.Checksum), limits(h))
+	d.OnProgress(1<<20, func(in, out int64) { prog.setOut(out) })
+	_, err = d.WriteTo(ioutil.Discard)
+	if err == nil {
+		prog.setOut(h.SizeHint)
+	}
+	if unmapErr := unmapFile(f, out, true); err == nil {
+		err = unmapErr
+	}
+	if err != nil || f == w {
+		return err
+	}
+	_, err = io.Copy(w, io.NewSectionReader(f, 0, h.SizeHint))
+	return err
+}
@@ -0,0 +1,162 @@
+package framing
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"math/bits"
+
+	"github.com/vova616/xxhash"
+)
+
+var ErrUnknownChecksum = errors.New("unknown checksum algorithm")
+
+// names for the checksum algorithms, as histzip's -checksum flag takes them
+var checksumNames = map[string]byte{
+	"xxh32":  ChecksumXXHash32,
+	"none":   ChecksumNone,
+	"xxh64":  ChecksumXXHash64,
+	"crc32c": ChecksumCRC32C,
+	"sha256": ChecksumSHA256,
+}
+
+// Returns the id for a checksum algorithm's name (xxh32, none, xxh64, crc32c, or
+// sha256).
+func ChecksumID(name string) (byte, error) {
+	id, ok := checksumNames[name]
+	if !ok {
+		return 0, ErrUnknownChecksum
+	}
+	return id, nil
+}
+
+// Returns a fresh hash for the checksum algorithm id, or nil for ChecksumNone
+// (which lrcompress takes to mean no checksum).
+func NewChecksum(id byte) (hash.Hash, error) {
+	switch id {
+	case ChecksumXXHash32:
+		return xxhash.New(0), nil
+	case ChecksumNone:
+		return nil, nil
+	case ChecksumXXHash64:
+		return newXXHash64(), nil
+	case ChecksumCRC32C:
+		return crc32.New(crc32.MakeTable(crc32.Castagnoli)), nil
+	case ChecksumSHA256:
+		return sha256.New(), nil
+	}
+	return nil, ErrUnknownChecksum
+}
+
+// xxHash64 with seed 0, since the xxhash package only has the 32-bit version. Sum
+// appends the hash big-endian.
+type xxHash64 struct {
+	v     [4]uint64
+	total uint64
+	buf   [32]byte
+	n     int // bytes in buf
+}
+
+const (
+	prime64_1 = 11400714785074694791
+	prime64_2 = 14029467366897019727
+	prime64_3 = 1609587929392839161
+	prime64_4 = 9650029242287828579
+	prime64_5 = 2870177450012600261
+)
+
+func newXXHash64() hash.Hash64 {
+	x := &xxHash64{}
+	x.Reset()
+	return x
+}
+
+func xxRound(acc, input uint64) uint64 {
+	acc += input * prime64_2
+	return bits.RotateLeft64(acc, 31) * prime64_1
+}
+
+func xxMerge(acc, v uint64) uint64 {
+	acc ^= xxRound(0, v)
+	return acc*prime64_1 + prime64_4
+}
+
+func (x *xxHash64) Reset() {
+	p1 := uint64(prime64_1) // so the arithmetic wraps
+	x.v = [4]uint64{p1 + prime64_2, prime64_2, 0, -p1}
+	x.total, x.n = 0, 0
+}
+
+func (x *xxHash64) Size() int      { return 8 }
+func (x *xxHash64) BlockSize() int { return 32 }
+
+func (x *xxHash64) stripe(p []byte) {
+	for i := range x.v {
+		x.v[i] = xxRound(x.v[i], binary.LittleEndian.Uint64(p[i*8:]))
+	}
+}
+
+func (x *xxHash64) Write(p []byte) (int, error) {
+	n := len(p)
+	x.total += uint64(n)
+	if x.n > 0 {
+		c := copy(x.buf[x.n:], p)
+		x.n += c
+		p = p[c:]
+		if x.n < len(x.buf) {
+			return n, nil
+		}
+		x.stripe(x.buf[:])
+		x.n = 0
+	}
+	for ; len(p) >= 32; p = p[32:] {
+		x.stripe(p)
+	}
+	x.n = copy(x.buf[:], p)
+	return n, nil
+}
+
+func (x *xxHash64) Sum64() uint64 {
+	var h uint64
+	if x.total >= 32 {
+		v := x.v
+		h = bits.RotateLeft64(v[0], 1) + bits.RotateLeft64(v[1], 7) +
+			bits.RotateLeft64(v[2], 12) + bits.RotateLeft64(v[3], 18)
+		for _, vi := range v {
+			h = xxMerge(h, vi)
+		}
+	} else {
+		h = prime64_5
+	}
+	h += x.total
+
+	p := x.buf[:x.n]
+	for ; len(p) >= 8; p = p[8:] {
+		h ^= xxRound(0, binary.LittleEndian.Uint64(p))
+		h = bits.RotateLeft64(h, 27)*prime64_1 + prime64_4
+	}
+	if len(p) >= 4 {
+		h ^= uint64(binary.LittleEndian.Uint32(p)) * prime64_1
+		h = bits.RotateLeft64(h, 23)*prime64_2 + prime64_3
+		p = p[4:]
+	}
+	for _, b := range p {
+		h ^= uint64(b) * prime64_5
+		h = bits.RotateLeft64(h, 11) * prime64_1
+	}
+
+	h ^= h >> 33
+	h *= prime64_2
+	h ^= h >> 29
+	h *= prime64_3
+	h ^= h >> 32
+	return h
+}
+
+func (x *xxHash64) Sum(b []byte) []byte {
+	var sum [8]byte
+	binary.BigEndian.PutUint64(sum[:], x.Sum64())
+	return append(b, sum[:]...)
+}
@@ -0,0 +1,217 @@
+// Package framing reads and writes the header of histzip's framing format (see
+// format.md), including the metadata records in its extra data.
+package framing
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+const Sig = "\xAC\x9A\xDC\xF0"  // random
+const VerMajor, VerMinor = 1, 7 // VerMajor++ if not back compat; 1.1 added CoderShort, 1.2 CoderFar, 1.3 CoderFlat, 1.4 CoderSync, 1.5 CoderHeaders, 1.6 CoderArchive, 1.7 CoderTar
+const OldMajor, OldMinor = 0, 2 // written if no 1.x features used
+
+// types of records in the header's extra data
+const (
+	RecCoder    = 1 // second-stage coders: Coder flags ORed together
+	RecIndex    = 2 // block index follows the compressed data (empty value)
+	RecBase     = 3 // delta against a base file: 8-byte length, 4-byte xxHash
+	RecName     = 4 // original file name, without directories
+	RecModTime  = 5 // original mtime, 8-byte Unix nanoseconds
+	RecMode     = 6 // original permission bits, 4 bytes
+	RecSize     = 7 // uncompressed size, 8 bytes
+	RecChecksum = 8 // block checksum algorithm: one of the Checksum consts
+	RecCreator  = 9 // program and version that wrote the file
+)
+
+// second-stage coders, flags for the coder record
+const (
+	CoderNone    = 0
+	CoderFlate   = 1   // DEFLATE over all the lrcompress data
+	CoderShort   = 2   // literals coded with short matches (lrcompress's ShortMatches)
+	CoderFar     = 4   // lrcompress data is the far layer, with references to old output
+	CoderFlat    = 8   // all earlier output is history, not just 1<<HistBits; needs the size record
+	CoderSync    = 16  // lrcompress blocks start with sync markers (lrcompress's SyncMarkers)
+	CoderHeaders = 32  // and have headers (lrcompress's BlockHeaders); always with CoderSync
+	CoderArchive = 64  // the data is an archive of many files, not one file's content
+	CoderTar     = 128 // the data is a tar, reordered in groups of members
+)
+
+// block checksum algorithms; see NewChecksum
+const (
+	ChecksumXXHash32 = 0 // seed 0; what files without a checksum record use
+	ChecksumNone     = 1
+	ChecksumXXHash64 = 2 // seed 0
+	ChecksumCRC32C   = 3 // CRC-32 with the Castagnoli polynomial
+	ChecksumSHA256   = 4
+)
+
+var (
+	ErrNotHistzip   = errors.New("input isn't histzip-compressed")
+	ErrNewerVersion = errors.New("file uses a newer version of format; upgrade, please")
+	ErrTruncated    = errors.New("header's extra data is truncated")
+	ErrTooLong      = errors.New("header's extra data is over 255 bytes")
+)
+
+// Header is the framing header. Zero values mean a record is absent (for
+// Checksum, the default algorithm).
+type Header struct {
+	HistBits           uint // log2 history size
+	VerMajor, VerMinor int  // as read; writing picks the oldest version that fits
+
+	Coder    byte        // second-stage coders
+	Index    bool        // a block index follows the compressed data
+	Base     []byte      // for deltas, the base file's length and checksum
+	Name     string      // original file name, without directories
+	ModTime  time.Time   // original modification time
+	Mode     os.FileMode // original permission bits
+	SizeHint int64       // uncompressed size, if known when compressing
+	Checksum byte        // block checksum algorithm
+	Creator  string      // program and version that wrote the file
+
+	Len int64 // bytes in the header as read or written
+}
+
+// Reads a header from r, leaving r at the start of the compressed data. Skips
+// records it doesn't know about.
+func ReadHeader(r io.Reader) (*Header, error) {
+	head := make([]byte, 8)
+	if _, err := io.ReadFull(r, head); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, ErrNotHistzip
+	} else if err != nil {
+		return nil, err
+	} else if string(head[:4]) != Sig {
+		return nil, ErrNotHistzip
+	}
+	h := &Header{HistBits: uint(head[4]), VerMajor: int(head[5]), VerMinor: int(head[6])}
+	if h.VerMajor > VerMajor {
+		return nil, ErrNewerVersion
+	}
+	extra := make([]byte, head[7])
+	if _, err := io.ReadFull(r, extra); err != nil {
+		return nil, ErrTruncated
+	}
+	h.Len = int64(len(head) + len(extra))
+
+	for len(extra) > 0 {
+		if len(extra) < 2 || len(extra) < 2+int(extra[1]) {
+			return nil, ErrTruncated
+		}
+		typ, val := extra[0], extra[2:2+int(extra[1])]
+		extra = extra[2+len(val):]
+		switch {
+		case typ == RecCoder && len(val) == 1:
+			h.Coder = val[0]
+		case typ == RecCoder: // more flags than fit in a byte, from a newer version
+			return nil, ErrNewerVersion
+		case typ == RecIndex:
+			h.Index = true
+		case typ == RecBase:
+			h.Base = val
+		case typ == RecName:
+			h.Name = string(val)
+		case typ == RecModTime && len(val) == 8:
+			h.ModTime = time.Unix(0, int64(binary.BigEndian.Uint64(val)))
+		case typ == RecMode && len(val) == 4:
+			h.Mode = os.FileMode(binary.BigEndian.Uint32(val)) & os.ModePerm
+		case typ == RecSize && len(val) == 8:
+			h.SizeHint = int64(binary.BigEndian.Uint64(val))
+		case typ == RecChecksum && len(val) == 1:
+			h.Checksum = val[0]
+		case typ == RecCreator:
+			h.Creator = string(val)
+		}
+	}
+	return h, nil
+}
+
+// Encodes the header, setting h.Len and the version fields.
+func (h *Header) MarshalBinary() ([]byte, error) {
+	var extra []byte
+	put := func(typ byte, val []byte) {
+		extra = append(append(extra, typ, byte(len(val))), val...)
+	}
+	putInt := func(typ byte, i uint64, size int) {
+		var buf [8]byte
+		binary.BigEndian.PutUint64(buf[:], i)
+		put(typ, buf[8-size:])
+	}
+	h.VerMajor, h.VerMinor = OldMajor, OldMinor
+	if h.Coder != CoderNone {
+		put(RecCoder, []byte{h.Coder})
+		h.VerMajor, h.VerMinor = VerMajor, 0 // old decoders would misread
+	}
+	if h.Coder&CoderShort != 0 {
+		h.VerMinor = 1 // older decoders refuse it, as an unknown coder
+	}
+	if h.Coder&CoderFar != 0 {
+		h.VerMinor = 2 // likewise
+	}
+	if h.Coder&CoderFlat != 0 {
+		h.VerMinor = 3
+	}
+	if h.Coder&CoderSync != 0 {
+		h.VerMinor = 4
+	}
+	if h.Coder&CoderHeaders != 0 {
+		h.VerMinor = 5
+	}
+	if h.Coder&CoderArchive != 0 {
+		h.VerMinor = 6
+	}
+	if h.Coder&CoderTar != 0 {
+		h.VerMinor = 7
+	}
+	if h.Index {
+		put(RecIndex, nil)
+	}
+	if h.Base != nil {
+		put(RecBase, h.Base)
+		if h.VerMajor < VerMajor {
+			h.VerMajor, h.VerMinor = VerMajor, 0 // old decoders would misread
+		}
+	}
+	if h.Name != "" {
+		if len(h.Name) > 255 {
+			return nil, ErrTooLong
+		}
+		put(RecName, []byte(h.Name))
+	}
+	if !h.ModTime.IsZero() {
+		putInt(RecModTime, uint64(h.ModTime.UnixNano()), 8)
+	}
+	if h.Mode != 0 {
+		putInt(RecMode, uint64(h.Mode&os.ModePerm), 4)
+	}
+	if h.SizeHint != 0 {
+		putInt(RecSize, uint64(h.SizeHint), 8)
+	}
+	put(RecChecksum, []byte{h.Checksum})
+	if h.Checksum != ChecksumXXHash32 && h.VerMajor < VerMajor {
+		h.VerMajor, h.VerMinor = VerMajor, 0 // old decoders would misread block ends
+	}
+	if h.Creator != "" {
+		put(RecCreator, []byte(h.Creator))
+	}
+	if len(extra) > 255 {
+		return nil, ErrTooLong
+	}
+
+	out := append([]byte(Sig), byte(h.HistBits), byte(h.VerMajor), byte(h.VerMinor), byte(len(extra)))
+	out = append(out, extra...)
+	h.Len = int64(len(out))
+	return out, nil
+}
+
+// Writes the header.
+func (h *Header) WriteTo(w io.Writer) (n int64, err error) {
+	b, err := h.MarshalBinary()
+	if err != nil {
+		return 0, err
+	}
+	m, err := w.Write(b)
+	return int64(m), err
+}
@@ -0,0 +1,151 @@
+package framing
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestHeader(t *testing.T) {
+	in := &Header{
+		HistBits: 22,
+		Index:    true,
+		Name:     "revisions.xml",
+		ModTime:  time.Unix(1388534400, 123),
+		Mode:     0640,
+		SizeHint: 1 << 33,
+		Creator:  "test",
+	}
+	var buf bytes.Buffer
+	if _, err := in.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if in.VerMajor != OldMajor || in.VerMinor != OldMinor {
+		t.Error("header without 1.x features wasn't written as", OldMajor, OldMinor)
+	}
+	buf.WriteString("data")
+	out, err := ReadHeader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Name != in.Name || !out.ModTime.Equal(in.ModTime) || out.Mode != in.Mode ||
+		out.SizeHint != in.SizeHint || out.Creator != in.Creator || !out.Index ||
+		out.HistBits != in.HistBits || out.Len != in.Len {
+		t.Errorf("read %+v, wrote %+v", out, in)
+	}
+	if buf.String() != "data" {
+		t.Error("ReadHeader didn't stop at the end of the header")
+	}
+
+	// unknown records are skipped; truncated ones, newer majors, and coder records
+	// that aren't one byte aren't OK
+	raw := []byte(Sig + "\x16\x00\x02\x07\xFE\x01x\x04\x02hi")
+	if h, err := ReadHeader(bytes.NewReader(raw)); err != nil || h.Name != "hi" {
+		t.Error("didn't skip unknown record:", err)
+	}
+	if _, err := ReadHeader(bytes.NewReader(raw[:len(raw)-1])); err != ErrTruncated {
+		t.Error("truncated header gave", err)
+	}
+	raw[5] = VerMajor + 1
+	if _, err := ReadHeader(bytes.NewReader(raw)); err != ErrNewerVersion {
+		t.Error("newer major version gave", err)
+	}
+	raw = []byte(Sig + "\x16\x01\x07\x04\x01\x02\x00\x01")
+	if _, err := ReadHeader(bytes.NewReader(raw)); err != ErrNewerVersion {
+		t.Error("two-byte coder record gave", err)
+	}
+
+	// base, coder, and non-default checksum records need a 1.x decoder; long names
+	// don't fit
+	in = &Header{HistBits: 22, Checksum: ChecksumSHA256}
+	if _, err := in.WriteTo(&buf); err != nil || in.VerMajor != VerMajor || in.VerMinor != 0 {
+		t.Error("header with SHA-256 checksums wasn't written as", VerMajor, 0, err)
+	}
+	in = &Header{HistBits: 22, Coder: CoderFlate}
+	if _, err := in.WriteTo(&buf); err != nil || in.VerMajor != VerMajor || in.VerMinor != 0 {
+		t.Error("header with coder wasn't written as", VerMajor, 0, err)
+	}
+	in = &Header{HistBits: 22, Coder: CoderFlate | CoderShort}
+	if _, err := in.WriteTo(&buf); err != nil || in.VerMajor != VerMajor || in.VerMinor != 1 {
+		t.Error("header with short matches wasn't written as", VerMajor, 1, err)
+	}
+	in = &Header{HistBits: 22, Coder: CoderShort | CoderFar}
+	if _, err := in.WriteTo(&buf); err != nil || in.VerMajor != VerMajor || in.VerMinor != 2 {
+		t.Error("header with far references wasn't written as", VerMajor, 2, err)
+	}
+	in = &Header{HistBits: 22, Coder: CoderFlat, SizeHint: 5}
+	if _, err := in.WriteTo(&buf); err != nil || in.VerMajor != VerMajor || in.VerMinor != 3 {
+		t.Error("header with flat history wasn't written as", VerMajor, 3, err)
+	}
+	in = &Header{HistBits: 22, Coder: CoderShort | CoderSync}
+	if _, err := in.WriteTo(&buf); err != nil || in.VerMajor != VerMajor || in.VerMinor != 4 {
+		t.Error("header with sync markers wasn't written as", VerMajor, 4, err)
+	}
+	in = &Header{HistBits: 22, Coder: CoderSync | CoderHeaders}
+	if _, err := in.WriteTo(&buf); err != nil || in.VerMajor != VerMajor || in.VerMinor != 5 {
+		t.Error("header with block headers wasn't written as", VerMajor, 5, err)
+	}
+	in = &Header{HistBits: 22, Coder: CoderArchive}
+	if _, err := in.WriteTo(&buf); err != nil || in.VerMajor != VerMajor || in.VerMinor != 6 {
+		t.Error("archive header wasn't written as", VerMajor, 6, err)
+	}
+	in = &Header{HistBits: 22, Coder: CoderSync | CoderTar}
+	if _, err := in.WriteTo(&buf); err != nil || in.VerMajor != VerMajor || in.VerMinor != 7 {
+		t.Error("reordered tar header wasn't written as", VerMajor, 7, err)
+	}
+	in = &Header{HistBits: 22, Name: string(make([]byte, 250)), Creator: "test"}
+	if _, err := in.WriteTo(&buf); err != ErrTooLong {
+		t.Error("too-long header gave", err)
+	}
+}
+
+func TestChecksums(t *testing.T) {
+	long := make([]byte, 1000)
+	for i := range long {
+		long[i] = byte(i*7 + 3)
+	}
+	vectors := []struct {
+		in  []byte
+		sum uint64
+	}{
+		{nil, 0xef46db3751d8e999},
+		{[]byte("a"), 0xd24ec4f1a98c6e5b},
+		{[]byte("abc"), 0x44bc2cf5ad770999},
+		{[]byte("Nobody inspects the spammish repetition"), 0xfbcea83c8a378bf1},
+		{long[:100], 0xa61f8d4c170fe531},
+		{long, 0x5f235fa033f1a3fb},
+	}
+	x := newXXHash64()
+	for _, v := range vectors {
+		// feed it in uneven pieces to exercise the buffering
+		for step := 1; step < 50; step += 12 {
+			x.Reset()
+			for p := v.in; len(p) > 0; {
+				n := step
+				if n > len(p) {
+					n = len(p)
+				}
+				x.Write(p[:n])
+				p = p[n:]
+			}
+			if x.Sum64() != v.sum {
+				t.Errorf("xxHash64 of %d bytes (step %d) was %x, want %x", len(v.in), step, x.Sum64(), v.sum)
+			}
+		}
+	}
+
+	for name, id := range checksumNames {
+		h, err := NewChecksum(id)
+		if err != nil {
+			t.Error(name, err)
+		} else if (h == nil) != (id == ChecksumNone) {
+			t.Error("wrong hash for", name)
+		}
+	}
+	if _, err := NewChecksum(255); err != ErrUnknownChecksum {
+		t.Error("unknown checksum gave", err)
+	}
+	if _, err := ChecksumID("md5"); err != ErrUnknownChecksum {
+		t.Error("unknown checksum name gave", err)
+	}
+}
@@ -4,32 +4,124 @@ package main
 
 import (
 	"bufio"
+	"compress/flate"
+	"errors"
+	"flag"
 	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strconv"
 	"strings"
 
+	"github.com/twotwotwo/histzip/framing"
 	"github.com/twotwotwo/histzip/lrcompress"
-	"github.com/vova616/xxhash"
 )
 
-const decompressMaxHistBits = 26 // read files w/up to this
-const Sig = "\xAC\x9A\xDC\xF0"   // random
-const VerMajor, VerMinor = 0, 2  // VerMajor++ if not back compat
+const decompressMaxHistBits = 26 // read files w/up to this by default
+const Creator = "histzip 1.1"    // written to the header's creator record
 const ChunkSize = 1 << 26
+const Suffix = ".hz" // added to compressed files' names
+
+var (
+	decompressFlag = flag.Bool("d", false, "decompress")
+	compressFlag   = flag.Bool("c", false, "compress (even if input looks compressed)")
+	outFlag        = flag.String("o", "", "write output to this file (- for stdout)")
+	keepFlag       = flag.Bool("k", false, "keep input files")
+	forceFlag      = flag.Bool("f", false, "overwrite existing output files")
+	testFlag       = flag.Bool("t", false, "test compressed input's integrity; write no output")
+	zipFlag        = flag.Bool("z", false, "compress output further with built-in flate (needs 1.x decompressor)")
+	shortFlag      = flag.Bool("short", false, "also code short repeats inside literals (needs 1.1+ decompressor)")
+	farFlag        = flag.Bool("far", false, "also find repeats any distance apart (decompressing needs a file or temp space; needs 1.2+ decompressor)")
+	mmapFlag       = flag.Bool("mmap", false, "map a regular input file into memory and use all of it as history (decompressing needs a file or temp space; needs 1.3+ decompressor)")
+	indexFlag      = flag.Bool("index", false, "append a block index allowing random access (not with -z)")
+	syncFlag       = flag.Bool("sync", false, "start each block with a marker and header -recover and -offset can find (needs 1.5+ decompressor)")
+	recoverFlag    = flag.Bool("recover", false, "when decompressing a file made with -sync, skip damaged blocks, writing zeros in their place, and report them (keeps input)")
+	restartFlag    = flag.Int("restart", 0, "start fresh history every `K` blocks of 64 MB, so reading can start there")
+	offsetFlag     = flag.Int64("offset", 0, "when decompressing a file with an index, start at this uncompressed `byte`")
+	lengthFlag     = flag.Int64("length", -1, "when decompressing a file with an index, stop after this many `bytes`")
+	histFlag       = flag.Uint("hist", lrcompress.CompHistBits, "when compressing, use 1<<`bits` bytes of history (20 to 30; over 26 needs -maxhist to decompress)")
+	maxHistFlag    = flag.Uint("maxhist", decompressMaxHistBits, "when decompressing, refuse files needing over 1<<`bits` bytes of history")
+	maxOutFlag     = flag.Int64("maxout", 0, "when decompressing, fail after this many `bytes` of output (0 for no limit)")
+	maxBlockFlag   = flag.Int64("maxblock", 0, "when decompressing, fail if a block is over this many `bytes` (0 for no limit)")
+	maxInstrFlag   = flag.Int64("maxinstr", 0, "when decompressing, fail if a literal or copy is over this many `bytes` (0 for no limit)")
+	noNameFlag     = flag.Bool("n", false, "don't save or restore the original file name and modification time")
+	checksumFlag   = flag.String("checksum", "xxh32", "when compressing, check blocks with `algorithm` xxh32, xxh64, crc32c, sha256, or none")
+	verboseFlag    = flag.Bool("v", false, "when compressing, print statistics (literals, copies, distances, hashtable hits) at exit")
+	jsonFlag       = flag.Bool("json", false, "with dump, print instructions as JSON, one object per line")
+	progressFlag   = flag.Bool("P", false, "print progress (bytes in and out, speed, ETA) to stderr every second")
+	archiveFlag    = flag.String("a", "", "archive the files and directories named to `file` (- for stdout), compressing them as one stream (needs 1.6+ to extract)")
+	extractFlag    = flag.Bool("x", false, "extract the archives named (or stdin) into the current directory, or -o's")
+	listFlag       = flag.Bool("l", false, "list the contents of the archives named (or stdin), with each file's size")
+	tarFlag        = flag.Bool("tar", false, "when compressing, read input as a tar and put each group of members' headers before their contents, reversibly (needs 1.7+ decompressor)")
+	tarSortFlag    = flag.Bool("tarsort", false, "with -tar, also sort each group's contents by name and size, so similar files land together")
+	tarBufFlag     = flag.Int64("tarbuf", 64<<20, "with -tar, reorder members in groups of up to this many `bytes` (bigger members go through in place); when decompressing, the biggest group to accept")
+)
+
+// second-stage coders this version reads
+const knownCoders = framing.CoderFlate | framing.CoderShort | framing.CoderFar | framing.CoderFlat | framing.CoderSync | framing.CoderHeaders | framing.CoderArchive | framing.CoderTar
+
+// the -checksum algorithm's id in the framing format
+var checksumID byte
+
+// -1 through -9 pick the compression level
+var levelFlags [lrcompress.MaxLevel + 1]*bool
+var level = lrcompress.DefaultLevel
+
+func init() {
+	for i := lrcompress.MinLevel; i <= lrcompress.MaxLevel; i++ {
+		usage := "compression level " + strconv.Itoa(i)
+		switch i {
+		case lrcompress.MinLevel:
+			usage = "compress fastest"
+		case lrcompress.DefaultLevel:
+			usage += " (the default)"
+		case lrcompress.MaxLevel:
+			usage = "compress best (more RAM and time)"
+		}
+		levelFlags[i] = flag.Bool(strconv.Itoa(i), false, usage)
+	}
+}
+
+// an output file we haven't finished; removed if we fail or are interrupted
+var partialOutput string
 
 func critical(a ...interface{}) {
+	if partialOutput != "" {
+		os.Remove(partialOutput)
+	}
 	fmt.Fprint(os.Stderr, "histzip failed: ")
 	fmt.Fprintln(os.Stderr, a...)
 	os.Exit(255)
 }
 
+func usage() {
+	fmt.Fprintln(os.Stderr, "to compress:   "+os.Args[0]+" [-k] [-f] [-o out.hz] file...")
+	fmt.Fprintln(os.Stderr, "               "+os.Args[0]+" < uncompressed.xml | bzip2 > compressed.hbz")
+	fmt.Fprintln(os.Stderr, "to decompress: "+os.Args[0]+" -d [-k] [-f] [-o out] file.hz...")
+	fmt.Fprintln(os.Stderr, "               bunzip2 < compressed.hbz | "+os.Args[0]+" > uncompressed.xml")
+	fmt.Fprintln(os.Stderr, "to test:       "+os.Args[0]+" -t file.hz...")
+	fmt.Fprintln(os.Stderr, "to archive:    "+os.Args[0]+" -a out.hza file-or-dir...")
+	fmt.Fprintln(os.Stderr, "to extract:    "+os.Args[0]+" -x [-o dir] [-f] out.hza")
+	fmt.Fprintln(os.Stderr, "to list:       "+os.Args[0]+" -l out.hza")
+	fmt.Fprintln(os.Stderr, "to diff:       "+os.Args[0]+" diff old new > delta")
+	fmt.Fprintln(os.Stderr, "to patch:      "+os.Args[0]+" patch old < delta > new")
+	fmt.Fprintln(os.Stderr, "to inspect:    "+os.Args[0]+" [-json] dump file.hz [old]")
+	fmt.Fprintln(os.Stderr, "to pick -hist: "+os.Args[0]+" analyze [file...]")
+	fmt.Fprintln(os.Stderr, "with no files, histzip reads stdin and writes stdout, compressing or")
+	fmt.Fprintln(os.Stderr, "decompressing depending on what the input looks like. flags:")
+	flag.PrintDefaults()
+}
+
 func exitWithUsage(reason string) {
+	if partialOutput != "" {
+		os.Remove(partialOutput)
+	}
 	fmt.Fprintln(os.Stderr, "histzip exiting:", reason)
-	fmt.Fprintln(os.Stderr, "to compress:   "+os.Args[0]+" < uncompressed.xml | bzip2 > compressed.hbz")
-	fmt.Fprintln(os.Stderr, "to decompress: bunzip2 < compressed.hbz | "+os.Args[0]+" > uncompressed.xml")
+	usage()
 	os.Exit(255)
 }
 
@@ -42,102 +134,617 @@ func rejectZippedInput(header string) {
 	}
 }
 
-// main() handles the framing format including checksums, and self-tests
+// Decides from the flags and the first bytes of input whether to decompress.
+func isCompressed(br *bufio.Reader) (bool, error) {
+	headBytes, err := br.Peek(8)
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	head := string(headBytes)
+	compressed := strings.HasPrefix(head, framing.Sig)
+	if *decompressFlag || *testFlag {
+		if !compressed {
+			return false, errors.New("input isn't histzip-compressed")
+		}
+		return true, nil
+	} else if *compressFlag {
+		return false, nil
+	}
+	rejectZippedInput(head)
+	return compressed, nil
+}
+
+// Picks the output name for a file argument when there's no -o. When
+// decompressing, h is the input's header, which may have the original name.
+func outputName(inName string, h *framing.Header) (string, error) {
+	if h == nil {
+		return inName + Suffix, nil
+	}
+	if name := filepath.Base(h.Name); h.Name != "" && !*noNameFlag && name != "." && name != ".." && name != string(filepath.Separator) {
+		return filepath.Join(filepath.Dir(inName), name), nil
+	}
+	if !strings.HasSuffix(inName, Suffix) || len(inName) == len(Suffix) {
+		return "", errors.New("don't know what to name output (no " + Suffix + " suffix); use -o")
+	}
+	return strings.TrimSuffix(inName, Suffix), nil
+}
+
+// Whether the file name is in, under another name or path (./data and data, say).
+func sameFile(in *os.File, name string) bool {
+	inInfo, err := in.Stat()
+	if err != nil {
+		return false
+	}
+	outInfo, err := os.Stat(name)
+	return err == nil && os.SameFile(inInfo, outInfo)
+}
+
+func createOutput(name string, perm os.FileMode) (*os.File, error) {
+	// read access is for -far and -mmap, which read back earlier output
+	flags := os.O_RDWR | os.O_CREATE | os.O_EXCL
+	if *forceFlag {
+		flags = os.O_RDWR | os.O_CREATE | os.O_TRUNC
+	}
+	f, err := os.OpenFile(name, flags, perm)
+	if os.IsExist(err) {
+		return nil, errors.New(name + " exists; use -f to overwrite")
+	} else if err != nil {
+		return nil, err
+	}
+	partialOutput = name
+	return f, nil
+}
+
+// Compresses, decompresses, or tests one input. inName is "-" for stdin, in which
+// case output goes to stdout unless there's an -o.
+func process(inName string) (err error) {
+	in, perm := os.Stdin, os.FileMode(0666)
+	meta := &framing.Header{HistBits: *histFlag, Index: *indexFlag, Checksum: checksumID, Creator: Creator}
+	if inName != "-" {
+		if in, err = os.Open(inName); err != nil {
+			return err
+		}
+		defer in.Close()
+		info, err := in.Stat()
+		if err != nil {
+			return err
+		} else if info.IsDir() {
+			return errors.New("is a directory")
+		}
+		perm = info.Mode().Perm()
+		meta.Mode, meta.SizeHint = perm, info.Size()
+		if !*noNameFlag {
+			meta.Name, meta.ModTime = filepath.Base(inName), info.ModTime()
+		}
+	}
+	var src io.Reader = in
+	if *progressFlag {
+		var size int64
+		if info, err := in.Stat(); err == nil && info.Mode().IsRegular() {
+			size = info.Size()
+		}
+		prog = startProgress(size)
+		defer func() {
+			prog.finish()
+			prog = nil
+		}()
+		src = progressReader{in}
+	}
+	br := bufio.NewReader(src)
+	decompressing, err := isCompressed(br)
+	if err != nil {
+		return err
+	}
+	var h *framing.Header // header of compressed input
+	if decompressing {
+		if h, err = readHeader(br); err != nil {
+			return err
+		}
+		if h.Coder&framing.CoderArchive != 0 && !*testFlag {
+			return errors.New("input is an archive; use -x or -l")
+		} else if h.Mode != 0 {
+			perm = h.Mode
+		}
+	}
+
+	// set up output
+	var out io.Writer = ioutil.Discard
+	var outFile *os.File
+	outName := *outFlag
+	if !*testFlag {
+		if outName == "" && inName == "-" {
+			outName = "-"
+		} else if outName == "" {
+			if outName, err = outputName(inName, h); err != nil {
+				return err
+			}
+		}
+		if outName == "-" {
+			out = os.Stdout
+		} else if outName == inName || sameFile(in, outName) {
+			return errors.New("output would overwrite input")
+		} else {
+			if outFile, err = createOutput(outName, perm); err != nil {
+				return err
+			}
+			out = outFile
+		}
+	}
+
+	// do the work
+	if prog != nil {
+		out = progressWriter{out}
+	}
+	if decompressing && (*offsetFlag > 0 || *lengthFlag >= 0) {
+		err = decompressRange(in, h, out)
+	} else if decompressing && h.Coder&framing.CoderTar != 0 {
+		err = decompressTar(in, br, h, out)
+	} else if decompressing {
+		err = decompress(in, br, h, out)
+	} else if *tarFlag {
+		err = compressTar(br, out, meta)
+	} else {
+		err = compress(in, br, out, meta)
+	}
+	if outFile != nil {
+		if closeErr := outFile.Close(); err == nil {
+			err = closeErr
+		}
+		if decompressing && err == nil && !h.ModTime.IsZero() && !*noNameFlag {
+			err = os.Chtimes(outName, h.ModTime, h.ModTime)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	partialOutput = ""
+	if inName != "-" && outName != "-" && !*keepFlag && !*testFlag && !*recoverFlag {
+		return os.Remove(inName)
+	}
+	return nil
+}
+
+// main() handles the command line; the functions it calls handle the framing
+// format including checksums, and self-tests
 func main() {
 
 	// MAKE SURE WE'RE INVOKED RIGHT AND GET SOME INFO
-	if len(os.Args) > 1 {
-		exitWithUsage("can't take any files or switches on command line; just pipe in input and redirect to output")
+	flag.Usage = usage
+	flag.Parse()
+	if *compressFlag && (*decompressFlag || *testFlag) {
+		exitWithUsage("can't both compress and decompress/test")
+	} else if *indexFlag && *zipFlag {
+		exitWithUsage("can't use -index with -z")
+	} else if *farFlag && (*indexFlag || *restartFlag > 0) {
+		exitWithUsage("can't use -far with -index or -restart")
+	} else if *mmapFlag && (*farFlag || *indexFlag || *restartFlag > 0) {
+		exitWithUsage("can't use -mmap with -far, -index, or -restart")
+	} else if *syncFlag && *restartFlag > 0 {
+		exitWithUsage("can't use -sync with -restart")
+	} else if *recoverFlag && (*offsetFlag > 0 || *lengthFlag >= 0) {
+		exitWithUsage("can't use -recover with -offset or -length")
+	} else if (*archiveFlag != "" && (*extractFlag || *listFlag)) || (*extractFlag && *listFlag) {
+		exitWithUsage("can only use one of -a, -x, and -l")
+	} else if *archiveFlag != "" && (*decompressFlag || *testFlag || *outFlag != "") {
+		exitWithUsage("can't use -a with -d, -t, or -o (-a names the output)")
+	} else if *archiveFlag != "" && *mmapFlag {
+		exitWithUsage("can't use -a with -mmap")
+	} else if (*extractFlag || *listFlag) && (*compressFlag || *offsetFlag > 0 || *lengthFlag >= 0) {
+		exitWithUsage("can't use -x or -l with -c, -offset, or -length")
+	}
+	if *tarSortFlag {
+		*tarFlag = true
+	}
+	if *tarFlag && (*archiveFlag != "" || *extractFlag || *listFlag) {
+		exitWithUsage("can't use -tar with -a, -x, or -l")
+	} else if *tarFlag && *mmapFlag {
+		exitWithUsage("can't use -tar with -mmap")
+	} else if *tarBufFlag < 1<<20 || *tarBufFlag > maxTarGroup {
+		exitWithUsage("-tarbuf must be between 1 MB and 1 GB")
+	} else if *restartFlag < 0 || *offsetFlag < 0 {
+		exitWithUsage("-restart and -offset can't be negative")
+	} else if *maxHistFlag > 40 {
+		exitWithUsage("-maxhist can't be over 40")
+	} else if *histFlag < lrcompress.MinHistBits || *histFlag > lrcompress.MaxHistBits {
+		exitWithUsage(fmt.Sprintf("-hist must be between %d and %d", lrcompress.MinHistBits, lrcompress.MaxHistBits))
+	}
+	var err error
+	if checksumID, err = framing.ChecksumID(*checksumFlag); err != nil {
+		exitWithUsage("unknown -checksum " + *checksumFlag)
+	}
+	levelSet := false
+	for i, set := range levelFlags {
+		if set != nil && *set {
+			if levelSet {
+				exitWithUsage("can only use one of -1 through -9")
+			}
+			level, levelSet = i, true
+		}
+	}
+	args := flag.Args()
+	if len(args) > 0 && (args[0] == "diff" || args[0] == "patch") {
+		if err := runDelta(args[0], args[1:]); err != nil {
+			critical(args[0]+":", err)
+		}
+		if *verboseFlag && stats.Blocks > 0 {
+			printStats(os.Stderr, &stats, statsHistBits)
+		}
+		return
+	} else if len(args) > 0 && args[0] == "dump" {
+		if err := runDump(args[1:]); err != nil {
+			critical("dump:", err)
+		}
+		return
+	} else if len(args) > 0 && args[0] == "analyze" {
+		if err := runAnalyze(args[1:]); err != nil {
+			critical("analyze:", err)
+		}
+		return
+	}
+	if *archiveFlag != "" && len(args) == 0 {
+		exitWithUsage("-a needs files or directories to archive")
+	}
+	if len(args) == 0 {
+		args = []string{"-"}
+	} else if len(args) > 1 && *outFlag != "" && *outFlag != "-" && !*extractFlag {
+		exitWithUsage("can only use -o with one input file")
 	}
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
 	go func() {
 		<-c
 		exitWithUsage("got interrupt")
 	}()
-	br := bufio.NewReader(os.Stdin)
-	headBytes, err := br.Peek(8)
-	if err != nil {
-		exitWithUsage("couldn't read input on stdin (" + err.Error() + ")")
+
+	if *archiveFlag != "" {
+		if err := runArchive(*archiveFlag, args); err != nil {
+			critical(*archiveFlag+":", err)
+		}
+		if *verboseFlag && stats.Blocks > 0 {
+			printStats(os.Stderr, &stats, statsHistBits)
+		}
+		return
+	} else if *extractFlag || *listFlag {
+		for _, name := range args {
+			if err := runExtract(name, *listFlag); err != nil {
+				if name == "-" {
+					critical(err)
+				}
+				critical(name+":", err)
+			}
+		}
+		if recoveredDamage {
+			os.Exit(2)
+		}
+		return
 	}
-	head := string(headBytes)
-	rejectZippedInput(head)
 
-	if head[:4] == Sig { // decompress
-		bits, vermajor, verminor, extra := uint(head[4]), int(head[5]), int(head[6]), int(head[7])
-		if vermajor > VerMajor {
-			critical("file uses a newer version of format; upgrade, please")
-		} else if bits > decompressMaxHistBits {
-			critical("file would need", 1<<(bits-20), "MB RAM for decompression (if that's OK, recompile with decompHistBits increased)")
+	for _, name := range args {
+		if err := process(name); err != nil {
+			if name == "-" {
+				critical(err)
+			}
+			critical(name+":", err)
 		}
-		for i := 0; i < extra+8; i++ { // skip extra data
-			_, err = br.ReadByte()
+	}
+	if *verboseFlag && stats.Blocks > 0 {
+		printStats(os.Stderr, &stats, statsHistBits)
+	}
+	if recoveredDamage {
+		os.Exit(2)
+	}
+}
+
+// Options for decompressing a file with header h: resource limits from the command
+// line, and whether the file uses short matches.
+func limits(h *framing.Header) *lrcompress.DecompressorOptions {
+	return &lrcompress.DecompressorOptions{
+		MaxOutputBytes:       *maxOutFlag,
+		MaxHistBits:          *maxHistFlag,
+		MaxBlockBytes:        *maxBlockFlag,
+		MaxInstructionLength: *maxInstrFlag,
+		ShortMatches:         h.Coder&framing.CoderShort != 0,
+		SyncMarkers:          h.Coder&framing.CoderSync != 0,
+		BlockHeaders:         h.Coder&framing.CoderHeaders != 0,
+	}
+}
+
+// Options for test-decompressing what we're compressing.
+func selfTestOptions() *lrcompress.DecompressorOptions {
+	return &lrcompress.DecompressorOptions{ShortMatches: *shortFlag, SyncMarkers: *syncFlag, BlockHeaders: *syncFlag}
+}
+
+// Compressor settings from the command line, with 1<<bits of history.
+func compressorOptions(bits uint) *lrcompress.CompressorOptions {
+	opts, _ := lrcompress.LevelOptions(level) // main checked the level
+	opts.HistBits, opts.ShortMatches = bits, *shortFlag
+	opts.SyncMarkers, opts.BlockHeaders = *syncFlag, *syncFlag
+	return opts
+}
+
+// Reads the framing header and checks it's something we can decompress.
+func readHeader(br *bufio.Reader) (*framing.Header, error) {
+	h, err := framing.ReadHeader(br)
+	if err != nil {
+		return nil, err
+	} else if h.HistBits > *maxHistFlag {
+		return nil, fmt.Errorf("file would need %d MB RAM for decompression (if that's OK, raise -maxhist to %d)", 1<<(h.HistBits-20), h.HistBits)
+	} else if _, err = framing.NewChecksum(h.Checksum); err != nil {
+		return nil, errors.New("file uses an unknown checksum; upgrade, please")
+	}
+	return h, nil
+}
+
+// Returns a fresh hash for checksum algorithm id, which main or readHeader has
+// already checked.
+func newHash(id byte) hash.Hash {
+	h, _ := framing.NewChecksum(id)
+	return h
+}
+
+// Decompresses from br, which should be just past in's framing header h. If in is
+// a file with an index and restart points, decompresses in parallel.
+func decompress(in *os.File, br *bufio.Reader, h *framing.Header, w io.Writer) error {
+	if h.Base != nil {
+		return errors.New("input is a delta; use histzip patch")
+	} else if h.Coder&^knownCoders != 0 {
+		return errors.New("file uses an unknown second-stage coder; upgrade, please")
+	}
+	if *recoverFlag {
+		return recoverOutput(in, br, h, w)
+	}
+	if h.Index && h.Coder&(framing.CoderFar|framing.CoderFlat) == 0 {
+		if info, err := in.Stat(); err == nil && info.Mode().IsRegular() {
+			x, err := lrcompress.ReadIndex(in, info.Size())
 			if err != nil {
-				critical(err)
+				return err
 			}
+			if x.Restart > 0 {
+				return decompressParallel(in, h, x, w)
+			}
+		}
+	}
+
+	// undo any second stage
+	var r io.Reader = br
+	if h.Coder&framing.CoderFlate != 0 {
+		fr := flate.NewReader(br)
+		defer fr.Close()
+		r = fr
+	}
+	if h.Coder&framing.CoderFlat != 0 {
+		return flatOutput(r, w, h)
+	}
+
+	d, err := lrcompress.NewDecompressorOptions(r, h.HistBits, newHash(h.Checksum), true, limits(h))
+	if err != nil {
+		return err
+	}
+	if h.Coder&framing.CoderFar != 0 {
+		fr := bufio.NewReader(d)
+		if err = farOutput(fr, w, h.Checksum); err != nil {
+			return err
+		}
+		// reading to the end checks the last block's checksum
+		if n, err := io.Copy(ioutil.Discard, fr); err != nil {
+			return err
+		} else if n > 0 {
+			return errors.New("data after end of far layer")
 		}
-		bw := bufio.NewWriter(os.Stdout)
-		_, err := io.Copy(bw, lrcompress.NewDecompressor(br, bits, xxhash.New(0), true))
-		if err != nil && !(err == io.ErrUnexpectedEOF && verminor == 0) {
-			critical(err)
-		} else if err = bw.Flush(); err != nil {
-			critical(err)
+		return nil
+	}
+	bw := bufio.NewWriter(w)
+	_, err = io.Copy(bw, d)
+	if err != nil && !(errors.Is(err, io.ErrUnexpectedEOF) && h.VerMajor == 0 && h.VerMinor == 0) {
+		return err
+	}
+	return bw.Flush()
+}
+
+// Decompresses the part of in that -offset and -length ask for, using the index to
+// skip to the nearest independent block. h is in's framing header.
+func decompressRange(in *os.File, h *framing.Header, w io.Writer) error {
+	if h.Coder&framing.CoderTar != 0 {
+		return errors.New("-offset and -length don't work on files compressed with -tar")
+	}
+	headers := h.Coder&framing.CoderHeaders != 0 && h.Coder&framing.CoderFlate == 0
+	if !(h.Index || headers) || h.Coder&(framing.CoderFar|framing.CoderFlat) != 0 {
+		return errors.New("-offset and -length need a file compressed with -index or -sync")
+	}
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	} else if !info.Mode().IsRegular() {
+		return errors.New("-offset and -length need a file, not a pipe")
+	}
+	var x *lrcompress.Index
+	if h.Index {
+		x, err = lrcompress.ReadIndex(in, info.Size())
+	} else { // find the blocks from their headers
+		sumSize := 0
+		if sum := newHash(h.Checksum); sum != nil {
+			sumSize = sum.Size()
+		}
+		x, err = lrcompress.ScanIndex(io.NewSectionReader(in, h.Len, info.Size()-h.Len), info.Size()-h.Len, sumSize)
+	}
+	if err != nil {
+		return err
+	}
+	blk := x.Find(*offsetFlag)
+	if blk < 0 {
+		return errors.New("index has no block to start from")
+	}
+
+	d, err := lrcompress.NewDecompressorAt(in, h.Len, x, blk, h.HistBits, newHash(h.Checksum), true, limits(h))
+	if err != nil {
+		return err
+	}
+	if _, err = io.CopyN(ioutil.Discard, d, *offsetFlag-x.Blocks[blk].Pos); err != nil {
+		if err == io.EOF {
+			return errors.New("-offset is past the end of the file")
 		}
-	} else { // compress
-		// WRITE HEADER
-		header := append([]byte{}, Sig...)
-		header = append(header, byte(lrcompress.CompHistBits), VerMajor, VerMinor, 0)
-		if _, err := os.Stdout.Write(header); err != nil {
-			critical("could not write header")
+		return err
+	}
+	limit := *lengthFlag
+	if limit < 0 {
+		limit = 1 << 62
+	}
+	bw := bufio.NewWriter(w)
+	if _, err = io.Copy(bw, io.LimitReader(d, limit)); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// Compresses br to w, writing the framing header h (to which this adds the coder)
+// and test-decompressing as we go.
+func compress(in *os.File, br *bufio.Reader, w io.Writer, h *framing.Header) error {
+	// WRITE HEADER
+	if *zipFlag {
+		h.Coder |= framing.CoderFlate
+	}
+	if *shortFlag {
+		h.Coder |= framing.CoderShort
+	}
+	if *farFlag {
+		h.Coder |= framing.CoderFar
+	}
+	if *syncFlag {
+		h.Coder |= framing.CoderSync | framing.CoderHeaders
+	}
+	var err error
+	var data []byte // with -mmap, the input
+	if *mmapFlag {
+		var flat bool
+		var cleanup func()
+		if data, flat, cleanup, err = mapInput(in, br); err != nil {
+			return err
+		} else if flat {
+			defer cleanup()
+			h.Coder |= framing.CoderFlat
+			h.SizeHint = int64(len(data))
 		}
+	}
+	_, err = h.WriteTo(w)
+	if err == framing.ErrTooLong { // a long name can crowd the rest out
+		h.Name = ""
+		_, err = h.WriteTo(w)
+	}
+	if err != nil {
+		return errors.New("could not write header")
+	}
+
+	// set up any second stage
+	out := w
+	var fw *flate.Writer
+	if *zipFlag {
+		fw, _ = flate.NewWriter(w, flate.DefaultCompression) // err only for bad level
+		w = fw
+	}
 
-		// go decompress and checksum
-		checkErr := make(chan error)
+	// with -far, compress the far layer instead of the input
+	var src io.Reader = br
+	if *farFlag {
+		ra, r, cleanup, err := farInput(in, br)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
 		pr, pw := io.Pipe()
-		w := io.MultiWriter(os.Stdout, pw)
+		defer pr.Close() // unblocks farPass if we fail
 		go func() {
-			d := lrcompress.NewDecompressor(pr, lrcompress.CompHistBits, xxhash.New(0), true)
-			_, err := d.WriteTo(ioutil.Discard) // Discard's ReadFrom hurts perf here
-			go io.Copy(ioutil.Discard, pr)      // ensure pipe drained even on err
-			checkErr <- err
+			pw.CloseWithError(farPass(ra, r, pw, h.HistBits, checksumID))
 		}()
+		src = pr
+	}
 
-		// compress
-		bw := bufio.NewWriter(w)
-		c := lrcompress.NewCompressor(bw, xxhash.New(0))
-		for {
-			_, err := io.CopyN(c, br, ChunkSize)
-			if err != nil { // something special happened
-				if err == io.EOF { // end of input
-					if err = c.Delimit(); err != nil { // finish block
-						critical(err)
-					}
-					break // we're done
-				} else if err != nil { // read/write error, bail out
-					critical(err)
-				}
-			}
-			// nothing special happened; just do next block
-			if err = c.Delimit(); err != nil {
-				critical(err)
-			}
-			// look for any test decompress errors mid-stream
-			select {
-			case err = <-checkErr: // bah; even EOF shouldn't happen yet here, so die
-				critical("test decompression error:", err)
-			default:
+	// compress
+	var blocks []lrcompress.BlockInfo
+	if h.Coder&framing.CoderFlat != 0 {
+		err = compressFlat(data, w)
+	} else if *restartFlag > 0 {
+		blocks, err = compressParallel(br, w, h.HistBits)
+	} else {
+		blocks, err = compressStream(src, w, h.HistBits, nil)
+	}
+	if err != nil {
+		return err
+	}
+	if fw != nil {
+		if err := fw.Close(); err != nil {
+			return err
+		}
+	}
+	if *indexFlag {
+		x := &lrcompress.Index{Restart: *restartFlag, Blocks: blocks}
+		if _, err := x.WriteTo(out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Compresses br to w a block at a time with 1<<bits of history, test-decompressing
+// as we go. If base isn't nil, its content is loaded as a dictionary first. Returns
+// the blocks for the index.
+func compressStream(br io.Reader, w io.Writer, bits uint, base io.Reader) ([]lrcompress.BlockInfo, error) {
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	bw := bufio.NewWriter(io.MultiWriter(w, pw))
+	c, err := lrcompress.NewCompressorOptions(bw, newHash(checksumID), compressorOptions(bits))
+	if err != nil {
+		return nil, err
+	}
+	d, err := lrcompress.NewDecompressorOptions(pr, bits, newHash(checksumID), true, selfTestOptions())
+	if err != nil {
+		return nil, err
+	}
+	if base != nil {
+		if err = loadBase(base, c, d); err != nil {
+			return nil, err
+		}
+	}
+
+	// go decompress and checksum
+	checkErr := make(chan error, 1)
+	go func() {
+		_, err := d.WriteTo(ioutil.Discard) // Discard's ReadFrom hurts perf here
+		go io.Copy(ioutil.Discard, pr)      // ensure pipe drained even on err
+		checkErr <- err
+	}()
+
+	// compress
+	for {
+		n, err := io.CopyN(c, br, ChunkSize)
+		if n > 0 { // finish block
+			if err := c.Delimit(); err != nil {
+				return nil, err
 			}
 		}
-		if err = c.Close(); err != nil { // writes a final end-of-block
-			critical(err)
-		} else if err = bw.Flush(); err != nil {
-			critical(err)
+		if err == io.EOF { // end of input
+			break
+		} else if err != nil { // read/write error, bail out
+			return nil, err
 		}
-		pw.Close()
-		// verify the test decompression worked
-		err = <-checkErr
-		if err != nil {
-			critical("test decompression error:", err)
+		// look for any test decompress errors mid-stream
+		select {
+		case err = <-checkErr: // bah; even EOF shouldn't happen yet here, so die
+			return nil, fmt.Errorf("test decompression error: %v", err)
+		default:
 		}
 	}
+	if err := c.Close(); err != nil { // writes a final end-of-block
+		return nil, err
+	} else if err = bw.Flush(); err != nil {
+		return nil, err
+	}
+	pw.Close()
+	// verify the test decompression worked
+	if err := <-checkErr; err != nil {
+		return nil, fmt.Errorf("test decompression error: %v", err)
+	}
+	s := c.Stats()
+	stats.Add(&s)
+	statsHistBits = bits
+	return c.Blocks(), nil
 }
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/twotwotwo/histzip/framing"
+	"github.com/twotwotwo/histzip/lrcompress"
+)
+
+// Compresses data to a file in dir with the flags as set, decompresses it with
+// plain -d, and returns the header and what came out.
+func roundTrip(t *testing.T, dir string, data []byte) (*framing.Header, []byte) {
+	name, hzName, outName := filepath.Join(dir, "data"), filepath.Join(dir, "data.hz"), filepath.Join(dir, "out")
+	if err := ioutil.WriteFile(name, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer func(keep bool, out string) { *keepFlag, *outFlag = keep, out }(*keepFlag, *outFlag)
+	*keepFlag, *outFlag = true, hzName
+	if err := process(name); err != nil {
+		t.Fatal("compressing:", err)
+	}
+	hz, err := os.Open(hzName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hz.Close()
+	h, err := framing.ReadHeader(hz)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(sync bool) { *syncFlag = sync }(*syncFlag)
+	*syncFlag, *outFlag = false, outName
+	if err := process(hzName); err != nil {
+		t.Fatal("decompressing:", err)
+	}
+	out, err := ioutil.ReadFile(outName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h, out
+}
+
+// Tests that -sync output, without -a or -tar, is a plain file that -d decompresses
+// as it was
+func TestSync(t *testing.T) {
+	defer func(sync bool) { *syncFlag = sync }(*syncFlag)
+	*syncFlag = true
+	data := bytes.Repeat([]byte("a line of text for -sync to compress\n"), 10000)
+	h, out := roundTrip(t, t.TempDir(), data)
+	if h.Coder&framing.CoderSync == 0 || h.Coder&(framing.CoderArchive|framing.CoderTar) != 0 {
+		t.Errorf("-sync output has coder flags %#x", h.Coder)
+	}
+	if !bytes.Equal(out, data) {
+		t.Error("-sync output didn't decompress to the input")
+	}
+}
+
+// Tests that restoreTar refuses groups bigger than -tarbuf or -maxout allow before
+// allocating for them
+func TestRestoreTarLimits(t *testing.T) {
+	// two segments, out of order, of 600 KB and 4 MB
+	group := []byte{2, 1, 0xc0, 0xcf, 0x24, 0, 0x80, 0x80, 0x80, 0x02}
+	if err := restoreTar(bytes.NewReader(group), ioutil.Discard, 1<<20, 0); err != errTarGroupBig {
+		t.Error("group over -tarbuf gave", err)
+	}
+	if err := restoreTar(bytes.NewReader(group), ioutil.Discard, 64<<20, 1<<20); err != lrcompress.ErrLimitExceeded {
+		t.Error("group over -maxout gave", err)
+	}
+	if err := restoreTar(bytes.NewReader(group), ioutil.Discard, 64<<20, 0); err != io.ErrUnexpectedEOF {
+		t.Error("truncated group gave", err)
+	}
+}
+
+// Tests that closing quit stops runWorkers' goroutines when the caller gives up
+// with segments still coming
+func TestRunWorkersQuit(t *testing.T) {
+	before := runtime.NumGoroutine()
+	quit := make(chan struct{})
+	segs := make(chan *segment)
+	go func() {
+		defer close(segs)
+		for {
+			select {
+			case segs <- &segment{done: make(chan struct{})}:
+			case <-quit:
+				return
+			}
+		}
+	}()
+	s := <-runWorkers(segs, func(*segment) {}, quit)
+	<-s.done
+	close(quit)
+	for i := 0; i < 100 && runtime.NumGoroutine() > before; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine() - before; n > 0 {
+		t.Error(n, "goroutines still running")
+	}
+}
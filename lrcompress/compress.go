@@ -2,28 +2,41 @@ package lrcompress
 
 import (
 	"encoding/binary"
+	"errors"
 	"hash"
 	"io"
+	"math/bits"
 )
 
-// Buffer size for compression, determined at compile time. Using a constant size
-// lets us use arrays (rather than slices) and make some other values constant, which
-// noticeably helped compression speed in tests.
+// Default buffer size for compression, determined at compile time. Using a constant
+// size lets us use arrays (rather than slices) and make some other values constant,
+// which noticeably helped compression speed in tests. Other sizes and settings work
+// through NewCompressorOptions, a bit more slowly.
 const CompHistBits = 22           // log2 bytes of history for compression
 const rMask = 1<<CompHistBits - 1 // &rMask turns offset into ring pos
 
+// range of history sizes NewCompressorSize accepts
+const MinHistBits, MaxHistBits = 20, 30
+
 // compression hashtable
-const hBits = 18           // log2 hashtable size
+const hBits = 18           // log2 hashtable size; other sizes scale it with history
 const hMask = 1<<hBits - 1 // c.hTbl[h>>hShift&hMask] is current hashtable entry
 const hShift = 32 - hBits
 const fMask = 1<<fBits - 1             // hit hashtable if fBits are 1111...
 const fBits = CompHistBits - hBits + 1 // 1/2 fill the table
 
-// output format choices
+// output format choices (defaults; see CompressorOptions)
 const window = 64          // bytes that must overlap to match
 const maxLiteral = 1 << 16 // we'll write this size literal
 const maxMatch = 1 << 18   // max match we output (we'll read 1<<histBits)
 
+const scoreLimit = 1 << 12 // bytes compared each way when scoring candidates
+
+// short matches within literals, if CompressorOptions.ShortMatches is set
+const shortMin = 4        // shortest short match (the format's minimum too)
+const shortBits = 16      // log2 short-match hashtable size
+const shortDist = 1 << 16 // farthest back we look for a short match
+
 type compRing [1 << CompHistBits]byte
 type compHtbl [1 << hBits]int64
 
@@ -35,30 +48,134 @@ func (c noChecksum) Reset()                            { return }
 func (c noChecksum) Size() int                         { return 0 }
 func (c noChecksum) BlockSize() int                    { return 1 }
 
+var BadHistBits = errors.New("history size out of range")
+
+// Wraps the output to count bytes written, for the block index.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (n int, err error) {
+	n, err = cw.w.Write(p)
+	cw.n += int64(n)
+	return
+}
+
 // Compressor is a Writer into which you can dump content.
 type Compressor struct {
-	pos        int64     // count of bytes ever written
-	ring       compRing  // the bytes
-	h          uint32    // current rolling hash
-	matchPos   int64     // current match start or 0
-	matchLen   int64     // current match length or 0
-	minMatch   int64     // lowest possible matchPos
-	cursor     int64     // "expected" match start
-	w          io.Writer // compressed output
-	literalLen int64     // current literal length or 0
-	encodeBuf  [16]byte  // for varints
-	hTbl       compHtbl  // hashtable holding offsets into source file
+	pos        int64           // count of bytes ever written
+	first      int64           // pos of the first byte (1, or 0 for a FlatCompressor)
+	out        int64           // pos of the next byte of output, for Stats
+	ring       []byte          // the bytes
+	rMask      int64           // &rMask turns offset into ring pos
+	histBits   uint            // log2 len(ring)
+	h          uint32          // current rolling hash
+	matchPos   int64           // current match start or 0
+	matchLen   int64           // current match length or 0
+	minMatch   int64           // lowest possible matchPos
+	cursor     int64           // "expected" match start
+	w          *countingWriter // compressed output
+	literalLen int64           // current literal length or 0
+	encodeBuf  [16]byte        // for varints
+	hTbl       []int64         // hashtable holding offsets into source file
+	hMask      uint32          // c.hTbl[h>>hShift&hMask*ways] is current bucket
+	hShift     uint32
+	ways       int64  // candidates per bucket, newest first
+	fMask      uint32 // hit hashtable if these bits of h are all 1
+	window     int64  // bytes that must overlap to match
+	maxLiteral int64
+	maxMatch   int64
+	fast       bool    // settings are the defaults, so Write can use constants
+	sTbl       []int64 // short-match hashtable, if we code literals with them
 	cksum      hash.Hash
 	sumBuf     []byte
+	sync       bool        // write sync markers?
+	headers    bool        // and block headers?
+	inBlock    bool        // written anything since the last Delimit?
+	blkLen     int64       // bytes in the current block, for its header
+	blocks     []BlockInfo // for the index
+	stats      Stats
+
+	progress      func(in, out int64) // see OnProgress
+	progressEvery int64
+	progressNext  int64
 }
 
 // Make a compressor with 1<<CompHistBits of memory, writing output to w, with h
 // as your checksum (h can be nil but that's' rarely what you want).
 func NewCompressor(w io.Writer, h hash.Hash) *Compressor {
+	c, _ := NewCompressorSize(w, h, CompHistBits)
+	return c
+}
+
+// Like NewCompressor, but with 1<<histBits bytes of history, which must be between
+// MinHistBits and MaxHistBits. The hashtable grows along with the history, so
+// expect to use about 1.5x the history size in RAM. Decompressors need to be told
+// the same histBits.
+func NewCompressorSize(w io.Writer, h hash.Hash, histBits uint) (*Compressor, error) {
+	return NewCompressorOptions(w, h, &CompressorOptions{HistBits: histBits})
+}
+
+// Like NewCompressorSize, but at a compression level between MinLevel and
+// MaxLevel (see LevelOptions). Decompressors don't need to know the level.
+func NewCompressorLevel(w io.Writer, h hash.Hash, histBits uint, level int) (*Compressor, error) {
+	opts, err := LevelOptions(level)
+	if err != nil {
+		return nil, err
+	}
+	opts.HistBits = histBits
+	return NewCompressorOptions(w, h, opts)
+}
+
+// Makes a compressor with the given settings, or returns BadHistBits or
+// BadOptions if they're out of range. opts can be nil for the defaults.
+func NewCompressorOptions(w io.Writer, h hash.Hash, opts *CompressorOptions) (*Compressor, error) {
+	o, err := opts.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	return newCompressor(w, h, o, make([]byte, 1<<o.HistBits), 1<<o.HistBits-1, 1), nil
+}
+
+// Makes a compressor with checked options o, history in ring, and the first byte
+// at position first.
+func newCompressor(w io.Writer, h hash.Hash, o CompressorOptions, ring []byte, rMask, first int64) *Compressor {
 	if h == nil {
 		h = noChecksum{}
 	}
-	return &Compressor{w: w, minMatch: 1, pos: 1, cursor: 1, cksum: h}
+	c := &Compressor{
+		w:          &countingWriter{w: w},
+		first:      first,
+		out:        first,
+		minMatch:   first,
+		pos:        first,
+		cursor:     first,
+		cksum:      h,
+		ring:       ring,
+		rMask:      rMask,
+		histBits:   o.HistBits,
+		hTbl:       make([]int64, int64(o.Ways)<<o.TableBits),
+		hMask:      1<<o.TableBits - 1,
+		hShift:     uint32(32 - o.TableBits),
+		ways:       int64(o.Ways),
+		fMask:      1<<o.SampleBits - 1,
+		window:     int64(o.MinMatch),
+		maxLiteral: int64(o.MaxLiteral),
+		maxMatch:   int64(o.MaxMatch),
+		fast:       o.fast(),
+		sync:       o.SyncMarkers,
+		headers:    o.BlockHeaders,
+	}
+	if o.ShortMatches {
+		c.sTbl = make([]int64, 1<<shortBits)
+	}
+	return c
+}
+
+// Log2 of the history size, which the decompressor needs to know.
+func (c *Compressor) HistBits() uint {
+	return c.histBits
 }
 
 func (c *Compressor) putInt(i int64) (err error) {
@@ -67,13 +184,62 @@ func (c *Compressor) putInt(i int64) (err error) {
 	return
 }
 
+// Notes where a block started, and writes any sync marker, when writing its first
+// instruction.
+func (c *Compressor) startBlock() error {
+	c.inBlock = true
+	c.blocks = append(c.blocks, BlockInfo{
+		Offset:      c.w.n,
+		Pos:         c.cursor - c.first,
+		Independent: c.minMatch >= c.cursor,
+	})
+	return c.putSync()
+}
+
+// Writes a sync marker, and any header, for a block starting at c.cursor, if
+// we're writing them.
+func (c *Compressor) putSync() (err error) {
+	if !c.sync {
+		return nil
+	}
+	if _, err = io.WriteString(c.w, syncMagic); err != nil {
+		return
+	}
+	var buf [2*binary.MaxVarintLen64 + 1]byte
+	n := 0
+	if c.headers {
+		n += binary.PutUvarint(buf[n:], uint64(c.stats.Blocks))
+	}
+	n += binary.PutUvarint(buf[n:], uint64(c.cursor-c.first))
+	if c.headers {
+		buf[n] = 0
+		if c.minMatch >= c.cursor {
+			buf[n] = blockIndependent
+		}
+		n++
+	}
+	_, err = c.w.Write(buf[:n])
+	return
+}
+
 func (c *Compressor) putMatch(matchPos, matchLen int64) (err error) {
+	if !c.inBlock {
+		if err = c.startBlock(); err != nil {
+			return
+		}
+	}
 	err = c.putInt(matchLen)
 	if err != nil {
 		return
 	}
 	err = c.putInt(matchPos - c.cursor)
 	c.cursor = matchPos + matchLen
+	c.blkLen += matchLen
+	c.stats.Copies++
+	c.stats.CopyBytes += matchLen
+	c.stats.Distances[bits.Len64(uint64(c.out-matchPos))]++
+	c.stats.Lengths[bits.Len64(uint64(matchLen))]++
+	c.out += matchLen
 	return
 }
 
@@ -81,30 +247,106 @@ func (c *Compressor) putLiteral(pos, literalLen int64) (err error) {
 	if literalLen == 0 {
 		return
 	}
+	if !c.inBlock {
+		if err = c.startBlock(); err != nil {
+			return
+		}
+	}
 	err = c.putInt(-literalLen)
 	if err != nil {
 		return
 	}
-	if literalLen > pos&rMask {
-		_, err = c.w.Write(c.ring[(pos-literalLen)&rMask:])
+	if c.sTbl != nil {
+		err = c.putShort(pos-literalLen, pos)
+	} else {
+		err = c.putRing(pos-literalLen, pos)
+	}
+	if err != nil {
+		return
+	}
+	c.cursor += literalLen
+	c.blkLen += literalLen
+	c.stats.Literals++
+	c.stats.LiteralBytes += literalLen
+	c.out += literalLen
+	return
+}
+
+// Writes the bytes from start to end out of the ring.
+func (c *Compressor) putRing(start, end int64) (err error) {
+	rMask := c.rMask
+	if end-start > end&rMask {
+		_, err = c.w.Write(c.ring[start&rMask:])
 		if err != nil {
 			return
 		}
-		_, err = c.w.Write(c.ring[:pos&rMask])
+		_, err = c.w.Write(c.ring[:end&rMask])
 	} else {
-		_, err = c.w.Write(c.ring[(pos-literalLen)&rMask : pos&rMask])
+		_, err = c.w.Write(c.ring[start&rMask : end&rMask])
 	}
-	if err != nil {
+	return
+}
+
+// Writes the literal bytes from start to end as runs and short matches (see
+// format.md), greedily taking the first match of shortMin+ bytes it finds.
+func (c *Compressor) putShort(start, end int64) (err error) {
+	ring, rMask, sTbl := c.ring, c.rMask, c.sTbl
+	var buf [binary.MaxVarintLen64]byte
+	putUvarint := func(i uint64) (err error) {
+		_, err = c.w.Write(buf[:binary.PutUvarint(buf[:], i)])
 		return
 	}
-	c.cursor += literalLen
+	run := start // raw bytes not yet written start here
+	for p := start; p+shortMin <= end; {
+		v := uint32(ring[p&rMask]) | uint32(ring[(p+1)&rMask])<<8 |
+			uint32(ring[(p+2)&rMask])<<16 | uint32(ring[(p+3)&rMask])<<24
+		slot := v * 2654435761 >> (32 - shortBits)
+		cand := sTbl[slot]
+		sTbl[slot] = p
+		if cand < c.minMatch || cand >= p || p-cand > shortDist {
+			p++
+			continue
+		}
+		l := int64(0)
+		for p+l < end && ring[(cand+l)&rMask] == ring[(p+l)&rMask] {
+			l++
+		}
+		if l < shortMin {
+			p++
+			continue
+		}
+		if run < p {
+			if err = putUvarint(uint64(p-run-1) << 1); err != nil {
+				return
+			} else if err = c.putRing(run, p); err != nil {
+				return
+			}
+		}
+		c.stats.ShortMatches++
+		c.stats.ShortBytes += l
+		if err = putUvarint(uint64(l-shortMin)<<1 | 1); err != nil {
+			return
+		} else if err = putUvarint(uint64(p - cand - 1)); err != nil {
+			return
+		}
+		p += l
+		run = p
+	}
+	if run < end {
+		if err = putUvarint(uint64(end-run-1) << 1); err != nil {
+			return
+		}
+		err = c.putRing(run, end)
+	}
 	return
 }
 
 // found a potential match; see if it checks out and use it if so
-func (c *Compressor) tryMatch(ring *compRing, pos, literalLen, minMatch, match int64) (matchLen_ int64, err error) {
+func (c *Compressor) tryMatch(pos, literalLen, minMatch, match int64) (matchLen_ int64, err error) {
+	ring, rMask := c.ring, c.rMask
 	matchPos, matchLen := match, int64(1) // 1 because cur. byte matched
-	min := pos - rMask + maxLiteral
+	c.stats.Candidates++
+	min := pos - rMask + c.maxLiteral
 	if min < minMatch {
 		min = minMatch
 	}
@@ -116,22 +358,66 @@ func (c *Compressor) tryMatch(ring *compRing, pos, literalLen, minMatch, match i
 		matchPos--
 		matchLen++
 	}
-	if matchLen >= window { // long enough match, flush literal and use it
+	if matchLen >= c.window { // long enough match, flush literal and use it
 		// this literal ends before pos-matchLen+1, not pos
 		if err = c.putLiteral(pos-matchLen+1, literalLen); err != nil {
 			return
 		}
+		c.stats.Hits++
 		return matchLen, error(nil)
 	} else { // short match, ignore
 		return 0, error(nil)
 	}
 }
 
+// Of the candidates in a bucket, returns the one that matches the most bytes
+// around pos (counting the upcoming bytes in ahead), or 0 if none could make a
+// match of window bytes.
+func (c *Compressor) bestMatch(pos, literalLen, minMatch int64, ahead []byte, cands []int64) (best int64) {
+	ring, rMask := c.ring, c.rMask
+	b := ahead[0]
+	min := pos - rMask + c.maxLiteral
+	if min < minMatch {
+		min = minMatch
+	}
+	bestScore := int64(0)
+	for _, match := range cands {
+		if match <= min || b != ring[match&rMask] {
+			continue
+		}
+		// same comparisons as tryMatch makes extending backwards
+		back := int64(0)
+		for back < literalLen && back < scoreLimit &&
+			match-back-1 > min &&
+			ring[(pos-back-1)&rMask] == ring[(match-back-1)&rMask] {
+			back++
+		}
+		if back+1 < c.window {
+			continue
+		}
+		// and forwards, as far as we have input and match is behind pos
+		fwd := int64(1)
+		for fwd < int64(len(ahead)) && fwd < scoreLimit && match+fwd < pos &&
+			ahead[fwd] == ring[(match+fwd)&rMask] {
+			fwd++
+		}
+		if back+fwd > bestScore {
+			best, bestScore = match, back+fwd
+		}
+	}
+	return best
+}
+
 // Compress content. Flush or Close once you're done, or not everything will be
 // written.
 func (c *Compressor) Write(p []byte) (n int, err error) {
-	h, ring, hTbl, pos, matchPos, matchLen, literalLen, minMatch := c.h, &c.ring, &c.hTbl, c.pos, c.matchPos, c.matchLen, c.literalLen, c.minMatch
+	if !c.fast {
+		return c.writeSized(p)
+	}
+	ring, hTbl := (*compRing)(c.ring), (*compHtbl)(c.hTbl)
+	h, pos, matchPos, matchLen, literalLen, minMatch := c.h, c.pos, c.matchPos, c.matchLen, c.literalLen, c.minMatch
 	c.cksum.Write(p)
+	c.stats.InputBytes += int64(len(p))
 	for _, b := range p {
 		// can use any 32-bit const with least sig. bits=10b and some higher
 		// bits set; even *=6 eventually mixes lower bits into the top ones
@@ -151,10 +437,11 @@ func (c *Compressor) Write(p []byte) (n int, err error) {
 				matchPos, matchLen = 0, 0
 			}
 		} else if literalLen > window && h&fMask == fMask {
+			c.stats.Lookups++
 			match := hTbl[h>>hShift&hMask]
 			// check if it's in usable range and cur. byte matches, then tryMatch
 			if match > minMatch && b == ring[match&rMask] && match > pos-rMask+maxLiteral {
-				matchLen, err = c.tryMatch(ring, pos, literalLen, minMatch, match)
+				matchLen, err = c.tryMatch(pos, literalLen, minMatch, match)
 				if matchLen > 0 {
 					literalLen = 0
 					matchPos = match - matchLen + 1
@@ -182,6 +469,71 @@ func (c *Compressor) Write(p []byte) (n int, err error) {
 		pos++
 	}
 	c.h, c.pos, c.matchPos, c.matchLen, c.literalLen = h, pos, matchPos, matchLen, literalLen
+	c.tick()
+	return len(p), nil
+}
+
+// Write for settings other than the default: the same as Write, but with the ring
+// and hashtable sizes and other settings in variables, and buckets of candidates.
+func (c *Compressor) writeSized(p []byte) (n int, err error) {
+	ring, hTbl, rMask, hMask, hShift, ways := c.ring, c.hTbl, c.rMask, c.hMask, c.hShift, c.ways
+	fMask, window, maxLiteral, maxMatch := c.fMask, c.window, c.maxLiteral, c.maxMatch
+	h, pos, matchPos, matchLen, literalLen, minMatch := c.h, c.pos, c.matchPos, c.matchLen, c.literalLen, c.minMatch
+	c.cksum.Write(p)
+	c.stats.InputBytes += int64(len(p))
+	for i, b := range p {
+		h *= ((0x703a03ac|1)*2)&(1<<32-1) | 1<<31
+		h ^= uint32(b)
+		// if we're in a match, extend or end it
+		if matchLen > 0 {
+			if ring[(matchPos+matchLen)&rMask] == b &&
+				matchLen < maxMatch {
+				matchLen++
+			} else {
+				if err = c.putMatch(matchPos, matchLen); err != nil {
+					return
+				}
+				matchPos, matchLen = 0, 0
+			}
+		} else if literalLen > window && h&fMask == fMask {
+			c.stats.Lookups++
+			slot := int64(h>>hShift&hMask) * ways
+			match := hTbl[slot]
+			if ways > 1 {
+				match = c.bestMatch(pos, literalLen, minMatch, p[i:], hTbl[slot:slot+ways])
+			}
+			if match > minMatch && b == ring[match&rMask] && match > pos-rMask+maxLiteral {
+				matchLen, err = c.tryMatch(pos, literalLen, minMatch, match)
+				if matchLen > 0 {
+					literalLen = 0
+					matchPos = match - matchLen + 1
+				} else if err != nil {
+					return
+				}
+			}
+		}
+		// (still) not in a match, so just extend the literal
+		if matchLen == 0 {
+			if literalLen == maxLiteral {
+				if err = c.putLiteral(pos, literalLen); err != nil {
+					return
+				}
+				literalLen = 0
+			}
+			literalLen++
+		}
+
+		// update hashtable and ring
+		ring[pos&rMask] = b
+		if h&fMask == fMask {
+			slot := int64(h>>hShift&hMask) * ways
+			copy(hTbl[slot+1:slot+ways], hTbl[slot:])
+			hTbl[slot] = pos
+		}
+		pos++
+	}
+	c.h, c.pos, c.matchPos, c.matchLen, c.literalLen = h, pos, matchPos, matchLen, literalLen
+	c.tick()
 	return len(p), nil
 }
 
@@ -195,7 +547,8 @@ func (c *Compressor) Reset() {
 
 // Loads dict content. Call only after init or Reset.
 func (c *Compressor) Load(p []byte) {
-	h, ring, hTbl, pos := c.h, &c.ring, &c.hTbl, c.pos
+	h, ring, hTbl, pos := c.h, c.ring, c.hTbl, c.pos
+	rMask, hMask, hShift, ways, fMask := c.rMask, c.hMask, c.hShift, c.ways, c.fMask
 	c.cksum.Write(p)
 	for _, b := range p {
 		// can use any 32-bit const with least sig. bits=10b and some higher
@@ -206,11 +559,13 @@ func (c *Compressor) Load(p []byte) {
 		// update hashtable and ring
 		ring[pos&rMask] = b
 		if h&fMask == fMask {
-			hTbl[h>>hShift&hMask] = pos
+			slot := int64(h>>hShift&hMask) * ways
+			copy(hTbl[slot+1:slot+ways], hTbl[slot:])
+			hTbl[slot] = pos
 		}
 		pos++
 	}
-	c.h, c.pos, c.cursor = h, pos, pos
+	c.h, c.pos, c.cursor, c.out = h, pos, pos, pos
 	return
 }
 
@@ -232,16 +587,59 @@ func (c *Compressor) Flush() (err error) {
 func (c *Compressor) Delimit() (err error) {
 	c.Flush()
 	c.sumBuf = c.cksum.Sum(c.sumBuf[:0])
+	if !c.inBlock { // an empty block gets a marker too
+		if err = c.putSync(); err != nil {
+			return
+		}
+	}
 	if err = c.putInt(0); err != nil {
 		return
-	} else if _, err = c.w.Write(c.sumBuf); err != nil {
+	}
+	if c.headers {
+		n := binary.PutUvarint(c.encodeBuf[:], uint64(c.blkLen))
+		if _, err = c.w.Write(c.encodeBuf[:n]); err != nil {
+			return
+		}
+	}
+	if _, err = c.w.Write(c.sumBuf); err != nil {
 		return
 	}
+	c.blkLen = 0
+	c.stats.Blocks++
 	c.cursor = c.pos
 	c.cksum.Reset()
+	c.inBlock = false
 	return
 }
 
+// Where each non-empty block written so far starts. Offsets count from the first
+// byte this Compressor wrote.
+func (c *Compressor) Blocks() []BlockInfo {
+	return c.blocks
+}
+
+// Has the compressor call f with the input bytes written so far and compressed
+// bytes output (not counting anything not yet flushed) about every `every` bytes of
+// input, from inside Write, for progress reports. f should be quick.
+func (c *Compressor) OnProgress(every int64, f func(in, out int64)) {
+	c.progress, c.progressEvery, c.progressNext = f, every, c.stats.InputBytes+every
+}
+
+// Calls the progress func if it's due.
+func (c *Compressor) tick() {
+	if c.progress != nil && c.stats.InputBytes >= c.progressNext {
+		c.progress(c.stats.InputBytes, c.w.n)
+		c.progressNext = c.stats.InputBytes + c.progressEvery
+	}
+}
+
+// What the compressor has done so far.
+func (c *Compressor) Stats() Stats {
+	s := c.stats
+	s.CompressedBytes = c.w.n
+	return s
+}
+
 // Writes an end-of-block marker; does not Flush or Close underlying writer.
 func (c *Compressor) Close() (err error) {
 	return c.Delimit()
@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"hash"
 	"io"
 )
@@ -14,18 +15,122 @@ type bufIOLike interface {
 	io.Reader
 }
 
-// Decompressor copies decompressed content to a Writer.
+// Wraps the input to count bytes read, so errors can say where they happened.
+type countingReader struct {
+	br bufIOLike
+	n  int64
+}
+
+func (r *countingReader) ReadByte() (b byte, err error) {
+	b, err = r.br.ReadByte()
+	if err == nil {
+		r.n++
+	}
+	return
+}
+
+func (r *countingReader) Read(p []byte) (n int, err error) {
+	n, err = r.br.Read(p)
+	r.n += int64(n)
+	return
+}
+
+var WrongChecksum = errors.New("checksum mismatch")
+
+// Returned (inside a CorruptInputError) when input breaks a DecompressorOptions limit.
+var ErrLimitExceeded = errors.New("decompression limit exceeded")
+
+var (
+	errCopyFuture  = errors.New("copy starts at current/future byte")
+	errCopyTooFar  = errors.New("copy starts too far back")
+	errCopyLong    = errors.New("copy too long")
+	errLiteralLong = errors.New("literal too long")
+	errShortLong   = errors.New("short match or run goes past end of literal")
+	errClosed      = errors.New("read from closed decompressor")
+)
+
+// CorruptInputError says what was wrong with compressed input and where. Err is
+// WrongChecksum for a checksum mismatch, io.ErrUnexpectedEOF for truncated input,
+// ErrLimitExceeded if input broke a DecompressorOptions limit, or another error
+// describing a bad instruction.
+type CorruptInputError struct {
+	Offset int64 // bytes read from the input before the bad instruction
+	Pos    int64 // uncompressed position (d.pos) when it started
+	Block  int64 // block number, counting from 0
+	Instr  int64 // the instruction (0 for end-of-block/checksum problems)
+	Err    error
+}
+
+func (e *CorruptInputError) Error() string {
+	return fmt.Sprintf("%v at compressed offset %d (block %d, uncompressed position %d, instruction %d)", e.Err, e.Offset, e.Block, e.Pos, e.Instr)
+}
+
+func (e *CorruptInputError) Unwrap() error {
+	return e.Err
+}
+
+// DecompressorOptions limits the resources a Decompressor will use, for reading
+// input you don't trust. Zero means no limit.
+type DecompressorOptions struct {
+	MaxOutputBytes       int64 // total output (not counting Load()ed content)
+	MaxHistBits          uint  // sizeBits to allow
+	MaxBlockBytes        int64 // output from one block
+	MaxInstructionLength int64 // length of one literal or copy
+
+	// Literals are coded as runs and short matches; must match the compressor's
+	// CompressorOptions.
+	ShortMatches bool
+
+	// Blocks start with sync markers, and maybe have headers; must match the
+	// compressor's too. BlockHeaders implies SyncMarkers.
+	SyncMarkers  bool
+	BlockHeaders bool
+}
+
+// Decompressor reads compressed content. Use it as an io.ReadCloser, or call
+// WriteTo (or io.Copy) to decompress to a Writer more efficiently.
 type Decompressor struct {
 	pos    int64     // count of bytes ever written
+	floor  int64     // copies can't start before this
 	mask   int64     // &mask turns pos into a Decompressor offset
 	w      io.Writer // output of writes/copies goes here as well as Decompressor
 	ring   []byte    // the bytes
-	br     bufIOLike
+	br     *countingReader
 	cksum  hash.Hash
 	sumBuf []byte
 	sumIn  []byte
 	concat bool // reading one block or any number of concatenated ones?
-	io.Reader
+	opts   DecompressorOptions
+	outLen int64 // output so far, for opts.MaxOutputBytes
+
+	progress      func(in, out int64) // see OnProgress
+	progressEvery int64
+	progressNext  int64
+
+	onCopy func(from, n int64) // for Recover, called as each copy starts
+
+	// for NewFlatDecompressor and NewFlatVerifier, ring is all the output
+	flat     bool
+	verify   bool // compare output to ring instead of storing it
+	mismatch bool // and it didn't match
+
+	// the current block and instruction, so Read can stop and start anywhere
+	inBlock   bool  // started reading the current block?
+	cursor    int64 // "expected" copy start; see format.md
+	blkLen    int64 // bytes the block has output so far
+	litLeft   int64 // literal bytes still to read
+	codedLeft int64 // bytes still to come from a literal's runs and short matches
+	copyFrom  int64 // start of the rest of the current copy...
+	copyLeft  int64 // ...and its length
+	blockEnd  bool  // Read hit the end of a block (concat is false)
+	done      bool  // hit the empty block at the end of the stream
+	closed    bool
+
+	// where we are, for CorruptInputErrors
+	block       int64 // blocks read
+	instr       int64 // current instruction
+	instrOffset int64 // compressed offset where it started
+	instrPos    int64 // d.pos where it started
 }
 
 // Makes decompressor. sizeBits is the log2 of the history buffer size (default
@@ -44,7 +149,7 @@ func NewDecompressor(r io.Reader, sizeBits uint, h hash.Hash, concat bool) *Deco
 		h = noChecksum{}
 	}
 	return &Decompressor{
-		br:     br,
+		br:     &countingReader{br: br},
 		pos:    0,
 		mask:   1<<sizeBits - 1,
 		ring:   make([]byte, 1<<sizeBits),
@@ -54,11 +159,30 @@ func NewDecompressor(r io.Reader, sizeBits uint, h hash.Hash, concat bool) *Deco
 	}
 }
 
+// Like NewDecompressor, but with limits on resource use (nil opts means none).
+// Returns ErrLimitExceeded if sizeBits is over opts.MaxHistBits.
+func NewDecompressorOptions(r io.Reader, sizeBits uint, h hash.Hash, concat bool, opts *DecompressorOptions) (*Decompressor, error) {
+	if opts == nil {
+		opts = &DecompressorOptions{}
+	}
+	if opts.MaxHistBits > 0 && sizeBits > opts.MaxHistBits {
+		return nil, ErrLimitExceeded
+	}
+	d := NewDecompressor(r, sizeBits, h, concat)
+	d.opts = *opts
+	if d.opts.BlockHeaders {
+		d.opts.SyncMarkers = true
+	}
+	return d, nil
+}
+
 // Clear state for reuse.
 func (d *Decompressor) Reset() {
-	d.pos = 0
+	d.pos, d.floor, d.outLen = 0, 0, 0
+	d.block = 0
 	d.cksum.Reset()
-	d.Reader = nil
+	d.inBlock, d.litLeft, d.copyLeft, d.codedLeft = false, 0, 0, 0
+	d.blockEnd, d.done, d.closed, d.mismatch = false, false, false, false
 }
 
 // Load dictionary content. Compressor and decompressor must load byte-identical
@@ -71,7 +195,11 @@ func (d *Decompressor) Load(p []byte) {
 		if pos+l > len(d.ring) {
 			l = len(d.ring) - pos
 		}
-		copy(d.ring[pos:pos+l], p[:l])
+		if !d.verify {
+			copy(d.ring[pos:pos+l], p[:l])
+		} else if !bytes.Equal(d.ring[pos:pos+l], p[:l]) {
+			d.mismatch = true
+		}
 		p = p[l:]
 		d.pos += int64(l)
 	}
@@ -83,150 +211,392 @@ func (d *Decompressor) write(p []byte) (n int, err error) {
 		return
 	}
 	d.Load(p)
+	d.tick()
 	return n, nil
 }
 
-// Copy old content to the current position. If the copy source overlaps the
+// Has the decompressor call f with its positions in the compressed and uncompressed
+// streams about every `every` bytes of output, from inside Read or WriteTo, for
+// progress reports. Positions count any Load()ed content, and with
+// NewDecompressorAt start from the block's. f should be quick.
+func (d *Decompressor) OnProgress(every int64, f func(in, out int64)) {
+	d.progress, d.progressEvery, d.progressNext = f, every, d.pos+every
+}
+
+// Calls the progress func if it's due.
+func (d *Decompressor) tick() {
+	if d.progress != nil && d.pos >= d.progressNext {
+		d.progress(d.br.n, d.pos)
+		d.progressNext = d.pos + d.progressEvery
+	}
+}
+
+// Copy the rest of the current copy to d.w. If the copy source overlaps the
 // destination, will produce repeats.
-func (d *Decompressor) copy(start int64, n int) (err error) {
-	N := n
-	for N > 0 && err == nil {
-		n = N
+func (d *Decompressor) copy() (written int64, err error) {
+	for d.copyLeft > 0 {
+		start, n := d.copyFrom, int(d.copyLeft)
 		q := int(start & d.mask)
 		// lower piece size (n) if needed
-		if start >= d.pos {
-			return errors.New("copy starts at current/future byte")
-		} else if start < 0 || start < d.pos-int64(len(d.ring)) {
-			return errors.New("copy starts too far back")
-		} else if start+int64(n) > d.pos { // src overlaps dest
+		if start+int64(n) > d.pos { // src overlaps dest
 			n = int(d.pos - start)
 		}
 		if q+n > len(d.ring) { // source wraps around
 			n = len(d.ring) - q
 		}
 		// do the copy and any write
-		start += int64(n)
-		if _, err := d.write(d.ring[q : q+n]); err != nil {
-			return err
+		d.copyFrom += int64(n)
+		d.copyLeft -= int64(n)
+		if _, err = d.write(d.ring[q : q+n]); err != nil {
+			return
 		}
-		N -= n
+		written += int64(n)
 	}
 	return
 }
 
-var WrongChecksum = errors.New("checksum mismatch")
+// Like copy, but copies as much as fits into p instead of writing.
+func (d *Decompressor) copyOut(p []byte) int {
+	start, n := d.copyFrom, len(p)
+	if int64(n) > d.copyLeft {
+		n = int(d.copyLeft)
+	}
+	q := int(start & d.mask)
+	if start+int64(n) > d.pos {
+		n = int(d.pos - start)
+	}
+	if q+n > len(d.ring) {
+		n = len(d.ring) - q
+	}
+	copy(p, d.ring[q:q+n])
+	d.Load(p[:n])
+	d.copyFrom += int64(n)
+	d.copyLeft -= int64(n)
+	return n
+}
 
-// Decompress a block from rd to w in one shot, retaining state at end.
-func (d *Decompressor) copyBlk(w io.Writer) (blkLen int64, err error) {
-	cursor := d.pos
+// Wraps err in a CorruptInputError for the current instruction.
+func (d *Decompressor) corrupt(err error) error {
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return &CorruptInputError{Offset: d.instrOffset, Pos: d.instrPos, Block: d.block, Instr: d.instr, Err: err}
+}
+
+// Checks that an instruction of length l is within d.opts's limits.
+func (d *Decompressor) checkLimits(l int64) error {
+	o := &d.opts
+	if d.flat && d.outLen+l > int64(len(d.ring)) {
+		return d.corrupt(errFlatLong)
+	}
+	if (o.MaxInstructionLength > 0 && l > o.MaxInstructionLength) ||
+		(o.MaxBlockBytes > 0 && d.blkLen+l > o.MaxBlockBytes) ||
+		(o.MaxOutputBytes > 0 && d.outLen+l > o.MaxOutputBytes) {
+		return d.corrupt(ErrLimitExceeded)
+	}
+	d.outLen += l
+	return nil
+}
+
+// Reads the next instruction, setting d.litLeft for a literal or d.copyFrom and
+// d.copyLeft for a copy. At end of block, checks the checksum and returns eob=true.
+// Returns a bare io.EOF if the input ends right where a block should have started.
+func (d *Decompressor) next() (eob bool, err error) {
 	br := d.br
-	d.w = w
+	if !d.inBlock {
+		d.inBlock, d.cursor, d.blkLen = true, d.pos, 0
+		if d.opts.SyncMarkers {
+			d.instrOffset, d.instrPos, d.instr = br.n, d.pos, 0
+			if err = d.readSync(); err == io.EOF {
+				d.inBlock = false
+				return false, err
+			} else if err != nil {
+				return false, d.corrupt(err)
+			}
+		}
+	}
 	maxLen := int64(len(d.ring))
-	var literalBuf [maxLiteral]byte
-	for {
-		instr, err := binary.ReadVarint(br)
+	d.instrOffset, d.instrPos, d.instr = br.n, d.pos, 0
+	instr, err := binary.ReadVarint(br)
+	if err == io.EOF && d.blkLen == 0 {
+		d.inBlock = false
+		return false, err
+	} else if err != nil {
+		return false, d.corrupt(err)
+	}
+	d.instr = instr
+	if instr > 0 { // copy!
+		l := instr
+		if l > maxLen {
+			return false, d.corrupt(errCopyLong)
+		} else if err = d.checkLimits(l); err != nil {
+			return false, err
+		}
+		cursorMove, err := binary.ReadVarint(br)
 		if err != nil {
-			return blkLen, err
+			return false, d.corrupt(err)
 		}
-		if instr > 0 { // copy!
-			l := instr
-			if l > maxLen {
-				return blkLen, errors.New("copy too long")
-			}
-			cursorMove, err := binary.ReadVarint(br)
+		start := d.cursor + cursorMove
+		if start >= d.pos {
+			return false, d.corrupt(errCopyFuture)
+		} else if start < d.floor || start < d.pos-maxLen {
+			return false, d.corrupt(errCopyTooFar)
+		}
+		d.copyFrom, d.copyLeft = start, l
+		d.cursor = start + l
+		d.blkLen += l
+		if d.onCopy != nil {
+			d.onCopy(start, l)
+		}
+	}
+	if instr == 0 { // end of block!
+		if d.opts.BlockHeaders {
+			l, err := binary.ReadUvarint(br)
 			if err != nil {
-				return blkLen, err
-			}
-			cursor += cursorMove
-			if err = d.copy(cursor, int(l)); err != nil {
-				return blkLen, err
+				return false, d.corrupt(err)
+			} else if int64(l) != d.blkLen {
+				return false, d.corrupt(errBlockLen)
 			}
-			cursor += l
-			blkLen += l
 		}
-		if instr == 0 { // end of block!
-			d.sumBuf = d.cksum.Sum(d.sumBuf[:0])
-			if _, err = io.ReadFull(br, d.sumIn); err != nil {
-				return blkLen, err
+		d.sumBuf = d.cksum.Sum(d.sumBuf[:0])
+		if _, err = io.ReadFull(br, d.sumIn); err != nil {
+			return false, d.corrupt(err)
+		}
+		if !bytes.Equal(d.sumBuf, d.sumIn) {
+			return false, d.corrupt(WrongChecksum)
+		} else if d.mismatch {
+			return false, d.corrupt(errMismatch)
+		} else if d.flat && d.blkLen == 0 && d.pos < int64(len(d.ring)) {
+			return false, d.corrupt(errFlatShort)
+		}
+		d.finishBlock()
+		return true, nil
+	}
+	if instr < 0 { // literal!
+		l := -instr
+		if l > maxLen {
+			return false, d.corrupt(errLiteralLong)
+		} else if err = d.checkLimits(l); err != nil {
+			return false, err
+		}
+		if d.opts.ShortMatches {
+			d.codedLeft = l
+		} else {
+			d.litLeft = l
+		}
+		d.cursor += l
+		d.blkLen += l
+	}
+	return false, nil
+}
+
+// Reads the next run or short match of a literal (see format.md), setting
+// d.litLeft or d.copyFrom and d.copyLeft.
+func (d *Decompressor) nextShort() error {
+	t, err := binary.ReadUvarint(d.br)
+	if err != nil {
+		return d.corrupt(err)
+	}
+	if t&1 == 0 { // run
+		l := int64(t>>1) + 1
+		if l <= 0 || l > d.codedLeft {
+			return d.corrupt(errShortLong)
+		}
+		d.litLeft = l
+		d.codedLeft -= l
+		return nil
+	}
+	l := int64(t>>1) + shortMin
+	dist, err := binary.ReadUvarint(d.br)
+	if err != nil {
+		return d.corrupt(err)
+	}
+	start := d.pos - int64(dist) - 1
+	if l <= 0 || l > d.codedLeft {
+		return d.corrupt(errShortLong)
+	} else if dist >= uint64(len(d.ring)) || start < d.floor {
+		return d.corrupt(errCopyTooFar)
+	}
+	d.copyFrom, d.copyLeft = start, l
+	d.codedLeft -= l
+	if d.onCopy != nil {
+		d.onCopy(start, l)
+	}
+	return nil
+}
+
+// Reads and checks the sync marker, and any header, starting a block. Returns a
+// bare io.EOF if the input ends right where it should have started.
+func (d *Decompressor) readSync() error {
+	var magic [len(syncMagic)]byte
+	if _, err := io.ReadFull(d.br, magic[:]); err != nil {
+		return err
+	} else if string(magic[:]) != syncMagic {
+		return errBadSync
+	}
+	var block uint64
+	var err error
+	if d.opts.BlockHeaders {
+		if block, err = binary.ReadUvarint(d.br); err != nil {
+			return err
+		}
+	}
+	pos, err := binary.ReadUvarint(d.br)
+	if err != nil {
+		return err
+	} else if int64(pos) != d.pos {
+		return errBadSync
+	}
+	if d.opts.BlockHeaders {
+		flags, err := d.br.ReadByte()
+		if err != nil {
+			return err
+		} else if int64(block) != d.block || flags&^blockIndependent != 0 {
+			return errBadSync
+		}
+		if flags&blockIndependent != 0 { // copies can't reach back past here
+			d.floor = d.pos
+		}
+	}
+	return nil
+}
+
+// Clears the checksum and moves on to the next block.
+func (d *Decompressor) finishBlock() {
+	d.cksum.Reset()
+	d.block++
+	d.inBlock = false
+}
+
+// Decompress the rest of a block from rd to w in one shot, retaining state at end.
+// Returns a bare io.EOF if the input ends right where the block should have started.
+func (d *Decompressor) copyBlk(w io.Writer) (written int64, err error) {
+	d.w = w
+	var literalBuf [maxLiteral]byte
+	for {
+		if d.litLeft > 0 {
+			chunk := int64(maxLiteral)
+			if chunk > d.litLeft {
+				chunk = d.litLeft
 			}
-			if !bytes.Equal(d.sumBuf, d.sumIn) {
-				return blkLen, WrongChecksum
+			if _, err = io.ReadFull(d.br, literalBuf[:chunk]); err != nil {
+				return written, d.corrupt(err)
 			}
-			d.cksum.Reset()
-			return blkLen, nil
-		}
-		if instr < 0 { // literal!
-			l := -instr
-			if l > maxLen {
-				return blkLen, errors.New("literal too long")
+			d.litLeft -= chunk
+			if _, err = d.write(literalBuf[:chunk]); err != nil {
+				return written, err
+			}
+			written += chunk
+		} else if d.copyLeft > 0 {
+			n, err := d.copy()
+			written += n
+			if err != nil {
+				return written, err
 			}
-			cursor += l
-			blkLen += l
-			for l > 0 {
-				chunk := int(l)
-				if chunk > maxLiteral {
-					chunk = maxLiteral
-				}
-				_, err := io.ReadFull(br, literalBuf[:chunk])
-				if err != nil {
-					return blkLen, err
-				}
-				if _, err = d.write(literalBuf[:chunk]); err != nil {
-					return blkLen, err
-				}
-				l -= int64(chunk)
+		} else if d.codedLeft > 0 {
+			if err = d.nextShort(); err != nil {
+				return written, err
 			}
+		} else if eob, err := d.next(); err != nil || eob {
+			return written, err
 		}
 	}
 }
 
 // Copy somewhere until you hit an empty block (like histzip does)
 func (d *Decompressor) copyUntilEmpty(w io.Writer) (written int64, err error) {
-	for err == nil {
+	for {
 		var n int64
 		n, err = d.copyBlk(w)
-		if n == 0 && err != nil {
-			return written, nil
-		}
 		written += n
+		if err != nil {
+			return
+		} else if d.blkLen == 0 {
+			d.done = true
+			return
+		}
 	}
-	return
 }
 
-// More efficient alternative to Read when appropriate.
+// More efficient alternative to Read when appropriate. If concat is false, reads
+// the rest of one block per call.
 func (d *Decompressor) WriteTo(w io.Writer) (written int64, err error) {
+	if d.closed {
+		return 0, errClosed
+	} else if d.done {
+		return 0, nil
+	}
+	d.blockEnd = false
 	if d.concat {
 		written, err = d.copyUntilEmpty(w)
 	} else {
 		written, err = d.copyBlk(w)
 	}
 	if err == io.EOF {
-		err = io.ErrUnexpectedEOF
+		err = d.corrupt(io.ErrUnexpectedEOF)
 	}
 	return
 }
 
 // Read decompressed content. If concat is false, this will return io.EOF at the end
-// of a block, and you can then call StartRead() to start on the next block. Reads
-// will often less than fill the buffer, and using io.Copy or WriteTo is usually 
-// more efficient.
+// of a block, and you can then call StartRead() to start on the next block. Using
+// io.Copy or WriteTo is usually more efficient.
 func (d *Decompressor) Read(p []byte) (n int, err error) {
-	if d.Reader == nil {
-		d.StartRead()
+	if d.closed {
+		return 0, errClosed
+	}
+	for n < len(p) {
+		if d.litLeft > 0 {
+			chunk := len(p) - n
+			if int64(chunk) > d.litLeft {
+				chunk = int(d.litLeft)
+			}
+			m, err := io.ReadFull(d.br, p[n:n+chunk])
+			d.Load(p[n : n+m])
+			d.litLeft -= int64(m)
+			n += m
+			if err != nil {
+				return n, d.corrupt(err)
+			}
+		} else if d.copyLeft > 0 {
+			n += d.copyOut(p[n:])
+		} else if d.codedLeft > 0 {
+			if err = d.nextShort(); err != nil {
+				return n, err
+			}
+		} else if d.done || d.blockEnd {
+			if n == 0 {
+				return 0, io.EOF
+			}
+			return n, nil
+		} else {
+			d.tick()
+			eob, err := d.next()
+			if err == io.EOF {
+				err = d.corrupt(io.ErrUnexpectedEOF)
+			}
+			if err != nil {
+				return n, err
+			}
+			if eob && !d.concat {
+				d.blockEnd = true
+			} else if eob && d.blkLen == 0 {
+				d.done = true
+			}
+		}
 	}
-	return d.Reader.Read(p)
+	return n, nil
 }
 
 // See Read(): if concat was set to false in NewDecompressor, call this to start on
 // the next block.
 func (d *Decompressor) StartRead() {
-	pr, pw := io.Pipe()
-	go func() {
-		_, err := d.WriteTo(pw)
-		if err == nil {
-			err = io.EOF
-		}
-		pw.CloseWithError(err)
-	}()
-	d.Reader = pr
+	d.blockEnd = false
+}
+
+// Stops decompression; Read and WriteTo will return errors afterwards. Doesn't
+// close the underlying Reader.
+func (d *Decompressor) Close() error {
+	d.closed = true
+	return nil
 }
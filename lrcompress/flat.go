@@ -0,0 +1,178 @@
+package lrcompress
+
+import (
+	"errors"
+	"hash"
+	"io"
+	"math/bits"
+)
+
+// "Ring" mask for flat (de)compressors, whose history is the whole input or
+// output: &flatMask leaves positions alone, and pos-flatMask is below any start.
+const flatMask = 1<<62 - 1
+
+var (
+	errFlatLong  = errors.New("output longer than expected")
+	errFlatShort = errors.New("output shorter than expected")
+	errMismatch  = errors.New("output doesn't match expected content")
+)
+
+// FlatCompressor compresses input that's all in memory at once, like an mmapped
+// file. It reads the input where it is instead of copying it into a ring, and all
+// of the input before the current position is history: copies can reach back to
+// the start, not just 1<<HistBits bytes. Decompress its output with
+// NewFlatDecompressor.
+type FlatCompressor struct {
+	c    *Compressor
+	data []byte
+}
+
+// Makes a FlatCompressor for data. Since the history is all of data, opts.HistBits
+// only scales the hashtable and the length limits in opts; if it's 0, it's picked
+// from len(data). With the default options, the hashtable takes about 1/2 of
+// len(data) in RAM.
+func NewFlatCompressor(w io.Writer, h hash.Hash, data []byte, opts *CompressorOptions) (*FlatCompressor, error) {
+	var o CompressorOptions
+	if opts != nil {
+		o = *opts
+	}
+	if o.HistBits == 0 {
+		o.HistBits = uint(bits.Len64(uint64(len(data))))
+		if o.HistBits < MinHistBits {
+			o.HistBits = MinHistBits
+		} else if o.HistBits > MaxHistBits {
+			o.HistBits = MaxHistBits
+		}
+	}
+	o, err := o.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	return &FlatCompressor{c: newCompressor(w, h, o, data, flatMask, 0), data: data}, nil
+}
+
+// Log2 of the history size the compressor's settings are scaled for.
+func (f *FlatCompressor) HistBits() uint {
+	return f.c.histBits
+}
+
+// Compresses up to n more bytes of the input. Returns how many it compressed,
+// which is 0 once it's reached the end.
+func (f *FlatCompressor) Next(n int64) (int64, error) {
+	c, data := f.c, f.data
+	if rest := int64(len(data)) - c.pos; n > rest {
+		n = rest
+	}
+	hTbl, hMask, hShift, ways := c.hTbl, c.hMask, c.hShift, c.ways
+	fMask, window, maxLiteral, maxMatch := c.fMask, c.window, c.maxLiteral, c.maxMatch
+	h, pos, matchPos, matchLen, literalLen, minMatch := c.h, c.pos, c.matchPos, c.matchLen, c.literalLen, c.minMatch
+	end := pos + n
+	c.cksum.Write(data[pos:end])
+	c.stats.InputBytes += n
+	for ; pos < end; pos++ {
+		b := data[pos]
+		h *= ((0x703a03ac|1)*2)&(1<<32-1) | 1<<31
+		h ^= uint32(b)
+		// the same as writeSized, except that the input is already in place
+		if matchLen > 0 {
+			if data[matchPos+matchLen] == b && matchLen < maxMatch {
+				matchLen++
+			} else {
+				if err := c.putMatch(matchPos, matchLen); err != nil {
+					return 0, err
+				}
+				matchPos, matchLen = 0, 0
+			}
+		} else if literalLen > window && h&fMask == fMask {
+			c.stats.Lookups++
+			slot := int64(h>>hShift&hMask) * ways
+			match := hTbl[slot]
+			if ways > 1 {
+				match = c.bestMatch(pos, literalLen, minMatch, data[pos:end], hTbl[slot:slot+ways])
+			}
+			if match > minMatch && b == data[match] {
+				var err error
+				matchLen, err = c.tryMatch(pos, literalLen, minMatch, match)
+				if matchLen > 0 {
+					literalLen = 0
+					matchPos = match - matchLen + 1
+				} else if err != nil {
+					return 0, err
+				}
+			}
+		}
+		if matchLen == 0 {
+			if literalLen == maxLiteral {
+				if err := c.putLiteral(pos, literalLen); err != nil {
+					return 0, err
+				}
+				literalLen = 0
+			}
+			literalLen++
+		}
+
+		if h&fMask == fMask {
+			slot := int64(h>>hShift&hMask) * ways
+			copy(hTbl[slot+1:slot+ways], hTbl[slot:])
+			hTbl[slot] = pos
+		}
+	}
+	c.h, c.pos, c.matchPos, c.matchLen, c.literalLen = h, pos, matchPos, matchLen, literalLen
+	c.tick()
+	return n, nil
+}
+
+// Writes out any pending match/literal, as Compressor.Flush does.
+func (f *FlatCompressor) Flush() error {
+	return f.c.Flush()
+}
+
+// Ends a block, as Compressor.Delimit does.
+func (f *FlatCompressor) Delimit() error {
+	return f.c.Delimit()
+}
+
+// Where each non-empty block written so far starts; see Compressor.Blocks.
+func (f *FlatCompressor) Blocks() []BlockInfo {
+	return f.c.Blocks()
+}
+
+// Calls f with progress about every `every` bytes; see Compressor.OnProgress. f is
+// called from Next, so at most once a call.
+func (f *FlatCompressor) OnProgress(every int64, fn func(in, out int64)) {
+	f.c.OnProgress(every, fn)
+}
+
+// What the compressor has done so far; see Compressor.Stats.
+func (f *FlatCompressor) Stats() Stats {
+	return f.c.Stats()
+}
+
+// Writes an end-of-block marker; does not Flush or Close underlying writer.
+func (f *FlatCompressor) Close() error {
+	return f.c.Close()
+}
+
+// Makes a decompressor for a FlatCompressor's output that writes its output into
+// out, which must be the size of the original input (an mmapped output file, say).
+// Copies can reach back to the start of out. Read it to the end (WriteTo with
+// ioutil.Discard is cheapest, since the output lands in out anyway); decompressing
+// more or less than len(out) bytes is an error. opts.MaxHistBits doesn't apply.
+func NewFlatDecompressor(r io.Reader, out []byte, h hash.Hash, opts *DecompressorOptions) *Decompressor {
+	d := NewDecompressor(r, 0, h, true)
+	d.ring, d.mask, d.flat = out, flatMask, true
+	if opts != nil {
+		d.opts = *opts
+	}
+	return d
+}
+
+// Like NewFlatDecompressor, but instead of writing into data, checks that the
+// output matches what's already there, returning an error if not. data can be
+// read-only, so this can test a FlatCompressor's output against its input without
+// a second copy.
+func NewFlatVerifier(r io.Reader, data []byte, h hash.Hash, opts *DecompressorOptions) *Decompressor {
+	d := NewFlatDecompressor(r, data, h, opts)
+	d.verify = true
+	return d
+}
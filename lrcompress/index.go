@@ -0,0 +1,138 @@
+package lrcompress
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"io"
+	"sort"
+)
+
+// BlockInfo says where a block starts in the compressed and uncompressed streams.
+type BlockInfo struct {
+	Offset      int64 // compressed bytes before the block
+	Pos         int64 // uncompressed bytes (including any Load()ed) before it
+	Independent bool  // no copies reach back before the block (after Reset, say)
+}
+
+// Index lists the blocks in a stream so a reader can start at an independent block
+// instead of the beginning. Restart is the application's restart policy: if it's K
+// (nonzero), history was Reset every K blocks. See format.md for the encoding.
+type Index struct {
+	Restart int
+	Blocks  []BlockInfo
+}
+
+const indexSig = "LRIX"
+
+var BadIndex = errors.New("block index missing or corrupt")
+
+// Writes the index, which is meant to go right after the compressed data.
+func (x *Index) WriteTo(w io.Writer) (n int64, err error) {
+	var buf bytes.Buffer
+	var varint [binary.MaxVarintLen64]byte
+	putUvarint := func(i uint64) {
+		buf.Write(varint[:binary.PutUvarint(varint[:], i)])
+	}
+	buf.WriteString(indexSig)
+	putUvarint(uint64(x.Restart))
+	putUvarint(uint64(len(x.Blocks)))
+	prev := BlockInfo{}
+	for _, b := range x.Blocks {
+		putUvarint(uint64(b.Offset - prev.Offset))
+		putUvarint(uint64(b.Pos - prev.Pos))
+		if b.Independent {
+			buf.WriteByte(1)
+		} else {
+			buf.WriteByte(0)
+		}
+		prev = b
+	}
+	// footer: length of what came before it, then signature again
+	binary.BigEndian.PutUint64(varint[:8], uint64(buf.Len()))
+	buf.Write(varint[:8])
+	buf.WriteString(indexSig)
+	return buf.WriteTo(w)
+}
+
+// Reads an index that ends at offset end in r (for a file, usually its size).
+func ReadIndex(r io.ReaderAt, end int64) (*Index, error) {
+	var footer [12]byte
+	if end < int64(len(footer)) {
+		return nil, BadIndex
+	} else if _, err := r.ReadAt(footer[:], end-int64(len(footer))); err != nil {
+		return nil, err
+	} else if string(footer[8:]) != indexSig {
+		return nil, BadIndex
+	}
+	l := int64(binary.BigEndian.Uint64(footer[:8]))
+	if l < int64(len(indexSig)) || l > end-int64(len(footer)) {
+		return nil, BadIndex
+	}
+	raw := make([]byte, l)
+	if _, err := r.ReadAt(raw, end-int64(len(footer))-l); err != nil {
+		return nil, err
+	} else if string(raw[:len(indexSig)]) != indexSig {
+		return nil, BadIndex
+	}
+
+	br := bytes.NewReader(raw[len(indexSig):])
+	restart, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, BadIndex
+	}
+	count, err := binary.ReadUvarint(br)
+	if err != nil || count > uint64(l)/3 { // each block takes at least 3 bytes
+		return nil, BadIndex
+	}
+	x := &Index{Restart: int(restart), Blocks: make([]BlockInfo, count)}
+	prev := BlockInfo{}
+	for i := range x.Blocks {
+		offsetDelta, err := binary.ReadUvarint(br)
+		if err != nil {
+			return nil, BadIndex
+		}
+		posDelta, err := binary.ReadUvarint(br)
+		if err != nil {
+			return nil, BadIndex
+		}
+		flags, err := br.ReadByte()
+		if err != nil {
+			return nil, BadIndex
+		}
+		prev = BlockInfo{
+			Offset:      prev.Offset + int64(offsetDelta),
+			Pos:         prev.Pos + int64(posDelta),
+			Independent: flags&1 != 0,
+		}
+		x.Blocks[i] = prev
+	}
+	return x, nil
+}
+
+// Finds the last independent block starting at or before uncompressed position pos,
+// or returns -1 if there isn't one.
+func (x *Index) Find(pos int64) int {
+	i := sort.Search(len(x.Blocks), func(i int) bool { return x.Blocks[i].Pos > pos })
+	for i--; i >= 0; i-- {
+		if x.Blocks[i].Independent {
+			return i
+		}
+	}
+	return -1
+}
+
+// Makes a decompressor that starts at block blk of a stream that begins at offset
+// base in r. The block should be independent; the decompressor will treat copies
+// from before it as corrupt input. The other arguments are as for
+// NewDecompressorOptions; opts can be nil for no limits.
+func NewDecompressorAt(r io.ReaderAt, base int64, x *Index, blk int, sizeBits uint, h hash.Hash, concat bool, opts *DecompressorOptions) (*Decompressor, error) {
+	b := x.Blocks[blk]
+	d, err := NewDecompressorOptions(io.NewSectionReader(r, base+b.Offset, 1<<62), sizeBits, h, concat, opts)
+	if err != nil {
+		return nil, err
+	}
+	d.pos, d.floor, d.block, d.br.n = b.Pos, b.Pos, int64(blk), b.Offset
+	return d, nil
+}
@@ -0,0 +1,132 @@
+package lrcompress
+
+import "io"
+
+// InstrKind says what an Instr is.
+type InstrKind int
+
+const (
+	Literal InstrKind = iota
+	Copy
+	EndOfBlock
+)
+
+func (k InstrKind) String() string {
+	switch k {
+	case Literal:
+		return "literal"
+	case Copy:
+		return "copy"
+	case EndOfBlock:
+		return "end"
+	}
+	return "unknown"
+}
+
+// Instr is one instruction from a compressed stream, as an InstrReader reads it.
+type Instr struct {
+	Kind   InstrKind
+	Offset int64 // compressed bytes before it
+	Pos    int64 // uncompressed bytes (including any Load()ed) before its output
+	Block  int64 // block number, counting from 0
+	Length int64 // bytes it outputs (for EndOfBlock, the block's length)
+
+	// for copies
+	CursorMove int64 // as stored (format.md calls it Advance)
+	From       int64 // uncompressed position the copy starts at (Pos-From bytes back)
+
+	// for literals with short matches, the runs and matches making them up
+	Tokens []Token
+
+	// for end of block, the checksum as stored, which matched
+	Checksum []byte
+}
+
+// Token is part of a literal coded with short matches: a run of Length bytes of
+// input, or if Distance isn't 0, Length bytes copied from Distance bytes back.
+type Token struct {
+	Pos      int64
+	Length   int64
+	Distance int64
+}
+
+// InstrReader reads a stream an instruction at a time, for debugging and analysis.
+// It still decompresses and checks checksums, since short matches and checksums
+// depend on the output.
+type InstrReader struct {
+	d   *Decompressor
+	buf []byte
+}
+
+// Makes an InstrReader reading from d, which should be freshly made (and Load()ed,
+// if the stream has dictionary content). It reads until the empty block ending the
+// stream, regardless of d's concat setting, and throws the output away.
+func NewInstrReader(d *Decompressor) *InstrReader {
+	d.w = io.Discard
+	return &InstrReader{d: d, buf: make([]byte, maxLiteral)}
+}
+
+// Reads and carries out the next instruction. Returns io.EOF after the empty block
+// ending the stream, or a CorruptInputError for bad input, with everything before
+// the bad instruction already returned.
+func (x *InstrReader) Next() (in Instr, err error) {
+	d := x.d
+	if d.closed {
+		return in, errClosed
+	} else if d.done {
+		return in, io.EOF
+	}
+	cursor, block := d.cursor, d.block
+	if !d.inBlock {
+		cursor = d.pos
+	}
+	eob, err := d.next()
+	if err == io.EOF {
+		err = d.corrupt(io.ErrUnexpectedEOF)
+	}
+	if err != nil {
+		return in, err
+	}
+	in = Instr{Offset: d.instrOffset, Pos: d.instrPos, Block: block}
+	switch {
+	case eob:
+		in.Kind, in.Length = EndOfBlock, d.blkLen
+		in.Checksum = append([]byte(nil), d.sumIn...)
+		d.done = d.blkLen == 0
+		return in, nil
+	case d.instr > 0:
+		in.Kind, in.Length, in.From = Copy, d.instr, d.copyFrom
+		in.CursorMove = d.copyFrom - cursor
+	default:
+		in.Kind, in.Length = Literal, -d.instr
+	}
+
+	// carry it out
+	for d.litLeft > 0 || d.copyLeft > 0 || d.codedLeft > 0 {
+		switch {
+		case d.litLeft > 0:
+			chunk := int64(len(x.buf))
+			if chunk > d.litLeft {
+				chunk = d.litLeft
+			}
+			if _, err = io.ReadFull(d.br, x.buf[:chunk]); err != nil {
+				return in, d.corrupt(err)
+			}
+			d.litLeft -= chunk
+			d.write(x.buf[:chunk])
+		case d.copyLeft > 0:
+			d.copy()
+		default:
+			pos := d.pos
+			if err = d.nextShort(); err != nil {
+				return in, err
+			}
+			t := Token{Pos: pos, Length: d.litLeft}
+			if d.copyLeft > 0 {
+				t.Length, t.Distance = d.copyLeft, pos-d.copyFrom
+			}
+			in.Tokens = append(in.Tokens, t)
+		}
+	}
+	return in, nil
+}
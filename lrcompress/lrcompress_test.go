@@ -5,9 +5,12 @@ package lrcompress
 import (
 	"bytes"
 	"crypto/rc4"
+	"encoding/binary"
+	"errors"
 	"hash"
 	"hash/crc32"
 	"io"
+	"reflect"
 	"testing"
 )
 
@@ -172,18 +175,754 @@ func TestRingWrap(t *testing.T) {
 	}
 }
 
-// these would be nice
+// Tests a repeat too far back for the default history size, but not for a bigger one
+func TestHistSizes(t *testing.T) {
+	a := make([]byte, 5<<20)
+	rndSource, err := rc4.NewCipher([]byte("hello"))
+	if err != nil {
+		t.Error("couldn't set up garbage source")
+	}
+	rndSource.XORKeyStream(a, a)
+	a = append(a, a[:1<<20]...)
+
+	if _, err := NewCompressorSize(nil, nil, MaxHistBits+1); err != BadHistBits {
+		t.Error("expected BadHistBits for too-big history, got", err)
+	}
+
+	for _, bits := range []uint{CompHistBits, 23} {
+		buf := new(bytes.Buffer)
+		c, err := NewCompressorSize(buf, crc(), bits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = c.Write(a)
+		if err != nil {
+			t.Error(err)
+		} else if err = c.Close(); err != nil {
+			t.Error(err)
+		}
+
+		found := buf.Len() < len(a)-(1<<19)
+		if bits == CompHistBits && found {
+			t.Error("found a match farther back than the history size")
+		} else if bits > CompHistBits && !found {
+			t.Error("did not find match with", bits, "bits of history")
+		}
+
+		b := new(bytes.Buffer)
+		d := NewDecompressor(buf, bits, crc(), false)
+		if _, err = d.WriteTo(b); err != nil {
+			t.Error(err, "unpacking")
+		} else if !bytes.Equal(a, b.Bytes()) {
+			t.Error("decompressed does not match original with", bits, "bits of history")
+		}
+	}
+}
+
+// Tests option checking, and that higher levels compress better and still round-trip
+func TestLevels(t *testing.T) {
+	// pairs of phrases, so the newest match for a phrase often isn't the longest
+	phrases := make([]byte, 64*150)
+	rndSource, err := rc4.NewCipher([]byte("hello"))
+	if err != nil {
+		t.Error("couldn't set up garbage source")
+	}
+	rndSource.XORKeyStream(phrases, phrases)
+	picks := make([]byte, 10000)
+	rndSource.XORKeyStream(picks, picks)
+	var a []byte
+	for _, p := range picks {
+		i := int(p%64) * 150
+		a = append(a, phrases[i:i+150]...)
+	}
+
+	if _, err := NewCompressorLevel(nil, nil, CompHistBits, MaxLevel+1); err != BadLevel {
+		t.Error("expected BadLevel for too-high level, got", err)
+	}
+	for _, o := range []CompressorOptions{
+		{MinMatch: 8},
+		{MaxMatch: 1 << 23},
+		{HistBits: 20, MaxLiteral: 1 << 19},
+		{Ways: 1000},
+		{TableBits: 30, Ways: 256},
+		{Ways: 32},
+	} {
+		if _, err := NewCompressorOptions(nil, nil, &o); err != BadOptions {
+			t.Errorf("expected BadOptions for %+v, got %v", o, err)
+		}
+	}
+
+	// unusual settings still make streams the decompressor takes
+	opts := &CompressorOptions{HistBits: 20, TableBits: 12, Ways: 3, MinMatch: 100, MaxLiteral: 1000, MaxMatch: 200}
+	buf := new(bytes.Buffer)
+	c, err := NewCompressorOptions(buf, crc(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Write(a)
+	c.Close()
+	b := new(bytes.Buffer)
+	if _, err = NewDecompressor(buf, 20, crc(), false).WriteTo(b); err != nil {
+		t.Error(err, "unpacking")
+	} else if !bytes.Equal(a, b.Bytes()) {
+		t.Errorf("decompressed does not match original with %+v", opts)
+	}
+
+	for _, bits := range []uint{CompHistBits, 23} {
+		sizes := []int{}
+		for level := MinLevel; level <= MaxLevel; level++ {
+			buf := new(bytes.Buffer)
+			c, err := NewCompressorLevel(buf, crc(), bits, level)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = c.Write(a); err != nil {
+				t.Error(err)
+			} else if err = c.Close(); err != nil {
+				t.Error(err)
+			}
+			sizes = append(sizes, buf.Len())
+
+			b := new(bytes.Buffer)
+			d := NewDecompressor(buf, bits, crc(), false)
+			if _, err = d.WriteTo(b); err != nil {
+				t.Error(err, "unpacking")
+			} else if !bytes.Equal(a, b.Bytes()) {
+				t.Error("decompressed does not match original at level", level)
+			}
+		}
+		if sizes[len(sizes)-1] >= sizes[0] {
+			t.Error("top level didn't beat level 1:", sizes)
+		}
+	}
+}
+
+// Tests that short matches shrink prose, round-trip through WriteTo and Read, and
+// that bad short-match literals are caught
+func TestShortMatches(t *testing.T) {
+	// "prose": words from a small vocabulary, plus some longer repeats
+	words := make([]byte, 2000)
+	rndSource, err := rc4.NewCipher([]byte("hello"))
+	if err != nil {
+		t.Error("couldn't set up garbage source")
+	}
+	rndSource.XORKeyStream(words, words)
+	var a []byte
+	for i := 0; i+1 < len(words); i += 2 {
+		w := int(words[i] % 200)
+		a = append(a, words[w:w+3+int(words[i+1]%6)]...)
+		a = append(a, ' ')
+	}
+	a = append(a, a...)
+
+	sizes := []int{}
+	for _, short := range []bool{false, true} {
+		buf := new(bytes.Buffer)
+		c, err := NewCompressorOptions(buf, crc(), &CompressorOptions{ShortMatches: short})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < len(a); i += 1000 { // several blocks, one after a Reset
+			end := i + 1000
+			if end > len(a) {
+				end = len(a)
+			}
+			c.Write(a[i:end])
+			c.Delimit()
+			if i == 2000 {
+				c.Reset()
+			}
+		}
+		c.Close()
+		sizes = append(sizes, buf.Len())
+
+		opts := &DecompressorOptions{ShortMatches: short}
+		d, _ := NewDecompressorOptions(bytes.NewReader(buf.Bytes()), CompHistBits, crc(), true, opts)
+		b := new(bytes.Buffer)
+		if _, err = d.WriteTo(b); err != nil {
+			t.Error(err, "unpacking")
+		} else if !bytes.Equal(a, b.Bytes()) {
+			t.Error("decompressed does not match original with ShortMatches", short)
+		}
+		// and through Read, a few bytes at a time
+		d, _ = NewDecompressorOptions(bytes.NewReader(buf.Bytes()), CompHistBits, crc(), true, opts)
+		b.Reset()
+		if _, err = io.CopyBuffer(b, struct{ io.Reader }{d}, make([]byte, 7)); err != nil {
+			t.Error(err, "reading")
+		} else if !bytes.Equal(a, b.Bytes()) {
+			t.Error("read does not match original with ShortMatches", short)
+		}
+	}
+	if sizes[1] >= sizes[0] {
+		t.Error("short matches didn't help:", sizes)
+	}
+
+	opts := &DecompressorOptions{ShortMatches: true}
+	tests := []struct {
+		name string
+		in   []byte
+		want error
+	}{
+		{"run past end of literal", stream(-5, "\x04abc\x04abc"), errShortLong},
+		{"match past end of literal", stream(-5, "\x04abc\x01\x02"), errShortLong},
+		{"match from too far back", stream(-7, "\x04abc\x01\x05"), errCopyTooFar},
+		{"truncated distance", stream(-7, "\x04abc\x01"), io.ErrUnexpectedEOF},
+	}
+	for _, test := range tests {
+		d, _ := NewDecompressorOptions(bytes.NewReader(test.in), 20, nil, false, opts)
+		if _, err := d.WriteTo(io.Discard); !errors.Is(err, test.want) {
+			t.Errorf("%s: got error %v, wanted %v", test.name, err, test.want)
+		}
+	}
+	d, _ := NewDecompressorOptions(bytes.NewReader(stream(-7, "\x04abc\x01\x02", 0)), 20, nil, false, opts)
+	b := new(bytes.Buffer)
+	if _, err := d.WriteTo(b); err != nil || b.String() != "abcabca" {
+		t.Errorf("got %q, %v; wanted abcabca", b.String(), err)
+	}
+}
+
+// Tests that Stats add up
+func TestStats(t *testing.T) {
+	// 100 KB repeated at 200 KB, and 10 KB repeated right after itself
+	a := make([]byte, 300000)
+	rndSource, err := rc4.NewCipher([]byte("hello"))
+	if err != nil {
+		t.Error("couldn't set up garbage source")
+	}
+	rndSource.XORKeyStream(a, a)
+	copy(a[200000:], a[:100000])
+	copy(a[110000:120000], a[100000:110000])
+
+	for _, opts := range []*CompressorOptions{nil, {Ways: 4}} {
+		buf := new(bytes.Buffer)
+		c, _ := NewCompressorOptions(buf, crc(), opts)
+		c.Write(a[:150000])
+		c.Delimit()
+		c.Write(a[150000:])
+		c.Close()
+		s := c.Stats()
+		if s.InputBytes != int64(len(a)) || s.LiteralBytes+s.CopyBytes != s.InputBytes {
+			t.Errorf("%+v: bytes don't add up: %+v", opts, s)
+		}
+		if s.CompressedBytes != int64(buf.Len()) || s.Blocks != 2 {
+			t.Errorf("%+v: %d compressed bytes in %d blocks, wanted %d in 2", opts, s.CompressedBytes, s.Blocks, buf.Len())
+		}
+		if s.Copies != 2 || s.Distances[14] != 1 || s.Distances[18] != 1 || s.Lengths[14] != 1 || s.Lengths[17] != 1 {
+			t.Errorf("%+v: unexpected copies %d, distances %v, lengths %v", opts, s.Copies, s.Distances[:20], s.Lengths[:20])
+		}
+		if s.Hits != s.Copies || s.Candidates < s.Hits || s.Lookups < s.Candidates {
+			t.Errorf("%+v: unexpected hashtable counts %+v", opts, s)
+		}
+		var total Stats
+		total.Add(&s)
+		total.Add(&s)
+		if total.Copies != 2*s.Copies || total.Lengths[17] != 2 {
+			t.Errorf("Add gave %+v", total)
+		}
+	}
+}
+
+// Tests that OnProgress calls come when due, with plausible counts
+func TestProgress(t *testing.T) {
+	a := make([]byte, 1<<20)
+	rndSource, err := rc4.NewCipher([]byte("hello"))
+	if err != nil {
+		t.Error("couldn't set up garbage source")
+	}
+	rndSource.XORKeyStream(a, a)
+
+	buf := new(bytes.Buffer)
+	c := NewCompressor(buf, crc())
+	var calls []int64
+	c.OnProgress(100000, func(in, out int64) {
+		calls = append(calls, in)
+		if out > in {
+			t.Errorf("progress with %d out for %d in", out, in)
+		}
+	})
+	for i := 0; i < len(a); i += 1 << 16 {
+		c.Write(a[i : i+1<<16])
+	}
+	c.Close()
+	if len(calls) != 8 || calls[0] != 1<<17 || calls[7] != 1<<20 {
+		t.Errorf("compressor progress calls at %v", calls)
+	}
+
+	size := int64(buf.Len())
+	d := NewDecompressor(buf, 22, crc(), false)
+	calls = nil
+	d.OnProgress(100000, func(in, out int64) {
+		calls = append(calls, out)
+		if in > size {
+			t.Errorf("progress with %d in", in)
+		}
+	})
+	if _, err = d.WriteTo(io.Discard); err != nil {
+		t.Error(err)
+	}
+	if len(calls) < 5 || calls[len(calls)-1] != 1<<20 {
+		t.Errorf("decompressor progress calls at %v", calls)
+	}
+}
+
+// Tests a FlatCompressor finding repeats beyond its HistBits, and decompressing
+// and verifying its output
+func TestFlat(t *testing.T) {
+	// 1 MB repeated 2 MB later
+	a := make([]byte, 3<<20)
+	rndSource, err := rc4.NewCipher([]byte("hello"))
+	if err != nil {
+		t.Error("couldn't set up garbage source")
+	}
+	rndSource.XORKeyStream(a, a)
+	copy(a[2<<20:], a[:1<<20])
+
+	ringBuf := new(bytes.Buffer)
+	c, _ := NewCompressorSize(ringBuf, crc(), 20)
+	c.Write(a)
+	c.Close()
+
+	buf := new(bytes.Buffer)
+	f, err := NewFlatCompressor(buf, crc(), a, &CompressorOptions{HistBits: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		n, err := f.Next(700000) // blocks not lined up with the repeat
+		if err != nil {
+			t.Fatal(err)
+		} else if n == 0 {
+			break
+		}
+		f.Delimit()
+	}
+	f.Close()
+	if buf.Len() > ringBuf.Len()*3/4 {
+		t.Error("flat output", buf.Len(), "bytes, not much smaller than", ringBuf.Len())
+	}
+	if blks := f.Blocks(); len(blks) != 5 || blks[0].Pos != 0 || !blks[0].Independent || blks[1].Pos != 700000 {
+		t.Errorf("unexpected blocks %+v", blks)
+	}
+
+	out := make([]byte, len(a))
+	d := NewFlatDecompressor(bytes.NewReader(buf.Bytes()), out, crc(), nil)
+	if _, err = d.WriteTo(io.Discard); err != nil {
+		t.Error(err, "unpacking")
+	} else if !bytes.Equal(a, out) {
+		t.Error("flat decompressed does not match original")
+	}
+	d = NewFlatVerifier(bytes.NewReader(buf.Bytes()), a, crc(), nil)
+	if _, err = io.CopyBuffer(io.Discard, struct{ io.Reader }{d}, make([]byte, 7777)); err != nil {
+		t.Error(err, "verifying")
+	}
+	out[2<<20+5]++
+	d = NewFlatVerifier(bytes.NewReader(buf.Bytes()), out, crc(), nil)
+	if _, err = d.WriteTo(io.Discard); !errors.Is(err, errMismatch) {
+		t.Error("verifying changed data got", err, "wanted", errMismatch)
+	}
+	for _, size := range []int{len(a) - 1, len(a) + 1} {
+		d = NewFlatDecompressor(bytes.NewReader(buf.Bytes()), make([]byte, size), crc(), nil)
+		if _, err = d.WriteTo(io.Discard); !errors.Is(err, errFlatLong) && !errors.Is(err, errFlatShort) {
+			t.Error("decompressing into", size, "bytes got", err)
+		}
+	}
+
+	// short matches, including from the first byte
+	text := bytes.Repeat([]byte("abcdefgh, abcdefgh. "), 100)
+	buf.Reset()
+	f, _ = NewFlatCompressor(buf, crc(), text, &CompressorOptions{ShortMatches: true})
+	f.Next(int64(len(text)))
+	f.Delimit()
+	f.Close()
+	out = make([]byte, len(text))
+	d = NewFlatDecompressor(bytes.NewReader(buf.Bytes()), out, crc(), &DecompressorOptions{ShortMatches: true})
+	if _, err = d.WriteTo(io.Discard); err != nil || !bytes.Equal(out, text) {
+		t.Error("flat with short matches didn't round-trip:", err)
+	}
+}
+
+// Tests Recover zeroing a damaged block, reporting copies from it, skipping markers
+// that turn out to be in the data, and carrying on when the end can't be found
+func TestRecover(t *testing.T) {
+	// four blocks; the last copies from the second and the first
+	a := make([]byte, 800000)
+	rndSource, err := rc4.NewCipher([]byte("hello"))
+	if err != nil {
+		t.Error("couldn't set up garbage source")
+	}
+	rndSource.XORKeyStream(a, a)
+	copy(a[650000:700000], a[250000:300000])
+	copy(a[700000:750000], a[50000:100000])
+
+	for _, headers := range []bool{false, true} {
+		buf := new(bytes.Buffer)
+		c, _ := NewCompressorOptions(buf, crc(), &CompressorOptions{SyncMarkers: true, BlockHeaders: headers})
+		for i := 0; i < len(a); i += 200000 {
+			c.Write(a[i : i+200000])
+			c.Delimit()
+		}
+		c.Close()
+		blocks := c.Blocks()
+		in := buf.Bytes()
+
+		opts := &DecompressorOptions{SyncMarkers: true, BlockHeaders: headers}
+		d, _ := NewDecompressorOptions(bytes.NewReader(in), 22, crc(), true, opts)
+		out := new(bytes.Buffer)
+		if _, err = d.WriteTo(out); err != nil || !bytes.Equal(out.Bytes(), a) {
+			t.Errorf("headers %v: sync markers didn't round-trip: %v", headers, err)
+		}
+		out.Reset()
+		losses, err := Recover(bytes.NewReader(in), int64(len(in)), out, 22, crc(), opts)
+		if err != nil || len(losses) > 0 || !bytes.Equal(out.Bytes(), a) {
+			t.Errorf("headers %v: undamaged recovery gave %v, losses %v", headers, err, losses)
+		}
+
+		// damage the second block
+		bad := append([]byte(nil), in...)
+		bad[blocks[1].Offset+100] ^= 1
+		out.Reset()
+		losses, err = Recover(bytes.NewReader(bad), int64(len(bad)), out, 22, crc(), opts)
+		if err != nil || len(losses) != 2 {
+			t.Fatalf("headers %v: damaged recovery gave %v, losses %v", headers, err, losses)
+		}
+		if l := losses[0]; l.Pos != 200000 || l.Length != 200000 || !errors.Is(l.Err, WrongChecksum) {
+			t.Errorf("headers %v: unexpected loss %+v", headers, l)
+		}
+		if l := losses[1]; l.Pos != 650000 || l.Length != 50000 || l.Err != ErrDamagedHistory {
+			t.Errorf("headers %v: unexpected loss %+v", headers, l)
+		}
+		b := out.Bytes()
+		if len(b) != len(a) || !bytes.Equal(b[:200000], a[:200000]) || !bytes.Equal(b[400000:650000], a[400000:650000]) || !bytes.Equal(b[700000:], a[700000:]) {
+			t.Errorf("headers %v: recovery damaged intact output", headers)
+		} else if !bytes.Equal(b[200000:400000], make([]byte, 200000)) {
+			t.Errorf("headers %v: recovery didn't zero the damaged block", headers)
+		}
+
+		// damage the last marker, so the end can't be found
+		bad = append([]byte(nil), in...)
+		bad[bytes.LastIndex(bad, []byte(syncMagic))+2] ^= 1
+		out.Reset()
+		losses, err = Recover(bytes.NewReader(bad), int64(len(bad)), out, 22, crc(), opts)
+		if err != nil || len(losses) != 1 || losses[0].Pos != 800000 || losses[0].Length != -1 || !bytes.Equal(out.Bytes(), a) {
+			t.Errorf("headers %v: damaged end gave %v, losses %v", headers, err, losses)
+		}
+		if !headers {
+			continue
+		}
+
+		// a stream inside the data, all one block, has markers that decode; after
+		// damage, Recover should skip them for the real end
+		nested := append(append(append([]byte(nil), a[:100000]...), in...), a[:100000]...)
+		nbuf := new(bytes.Buffer)
+		c, _ = NewCompressorOptions(nbuf, crc(), &CompressorOptions{SyncMarkers: true, BlockHeaders: headers})
+		c.Write(nested)
+		c.Delimit()
+		c.Close()
+		bad = nbuf.Bytes()
+		out.Reset()
+		losses, err = Recover(bytes.NewReader(bad), int64(len(bad)), out, 22, crc(), opts)
+		if err != nil || len(losses) > 0 || !bytes.Equal(out.Bytes(), nested) {
+			t.Errorf("headers %v: undamaged nested recovery gave %v, losses %v", headers, err, losses)
+		}
+		bad[1000] ^= 1
+		out.Reset()
+		losses, err = Recover(bytes.NewReader(bad), int64(len(bad)), out, 22, crc(), opts)
+		if err != nil || len(losses) != 1 || losses[0].Pos != 0 || losses[0].Length != int64(len(nested)) || out.Len() != len(nested) {
+			t.Errorf("headers %v: damaged nested recovery gave %v, losses %v", headers, err, losses)
+		}
+
+		// junk after the end is lost data, as far as Recover can tell
+		bad = append(append([]byte(nil), in...), "junk"...)
+		out.Reset()
+		losses, err = Recover(bytes.NewReader(bad), int64(len(bad)), out, 22, crc(), opts)
+		if err != nil || len(losses) != 1 || losses[0].Pos != 800000 || losses[0].Length != -1 || !bytes.Equal(out.Bytes(), a) {
+			t.Errorf("headers %v: junk after end gave %v, losses %v", headers, err, losses)
+		}
+	}
+}
+
+// Tests indexing a stream from its block headers, past a lookalike marker
+func TestScanIndex(t *testing.T) {
+	a := make([]byte, 800000)
+	rndSource, err := rc4.NewCipher([]byte("hello"))
+	if err != nil {
+		t.Error("couldn't set up garbage source")
+	}
+	rndSource.XORKeyStream(a, a)
+
+	// a Reset makes the third block independent; a marker inside a literal
+	// shouldn't fool ScanIndex
+	copy(a[300000:], syncMagic+"\x02\x80\xb5\x18\x01\x05")
+	buf := new(bytes.Buffer)
+	c, _ := NewCompressorOptions(buf, crc(), &CompressorOptions{BlockHeaders: true})
+	for i := 0; i < len(a); i += 200000 {
+		if i == 400000 {
+			c.Reset()
+		}
+		c.Write(a[i : i+200000])
+		c.Delimit()
+	}
+	c.Close()
+	in := buf.Bytes()
+
+	x, err := ScanIndex(bytes.NewReader(in), int64(len(in)), 4)
+	if err != nil || !reflect.DeepEqual(x.Blocks, c.Blocks()) {
+		t.Fatalf("ScanIndex gave %v, %+v, wanted %+v", err, x, c.Blocks())
+	}
+	if !x.Blocks[2].Independent || x.Blocks[1].Independent {
+		t.Errorf("wrong independent blocks: %+v", x.Blocks)
+	}
+	d, err := NewDecompressorAt(bytes.NewReader(in), 0, x, x.Find(500000), 22, crc(), true, &DecompressorOptions{BlockHeaders: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := new(bytes.Buffer)
+	if _, err = d.WriteTo(out); err != nil || !bytes.Equal(out.Bytes(), a[400000:]) {
+		t.Errorf("decompressing from scanned index gave %v", err)
+	}
+	if _, err = ScanIndex(bytes.NewReader(in[:len(in)-20]), int64(len(in)-20), 4); err != BadIndex {
+		t.Errorf("truncated stream gave %v", err)
+	}
+}
+
+// Tests Read with assorted buffer sizes across literals, copies and blocks, then
+// finishing with WriteTo, and Close
+func TestRead(t *testing.T) {
+	a := make([]byte, 300000)
+	rndSource, err := rc4.NewCipher([]byte("hello"))
+	if err != nil {
+		t.Error("couldn't set up garbage source")
+	}
+	rndSource.XORKeyStream(a, a)
+	copy(a[100000:], a[:100000])
+	for i := 250000; i < 260000; i++ {
+		a[i] = a[i-3]
+	}
+
+	buf := new(bytes.Buffer)
+	c := NewCompressor(buf, crc())
+	for i := 0; i < len(a); i += 70000 {
+		end := i + 70000
+		if end > len(a) {
+			end = len(a)
+		}
+		c.Write(a[i:end])
+		c.Delimit()
+	}
+	c.Close()
+
+	d := NewDecompressor(buf, 22, crc(), true)
+	var out []byte
+	sizes := []int{7, 1000, 70001, 1}
+	for i := 0; len(out) < 200000; i++ {
+		p := make([]byte, sizes[i%len(sizes)])
+		n, err := d.Read(p)
+		if err != nil {
+			t.Fatal("reading:", err)
+		}
+		out = append(out, p[:n]...)
+	}
+	rest := new(bytes.Buffer)
+	if _, err = d.WriteTo(rest); err != nil {
+		t.Fatal("WriteTo after Read:", err)
+	}
+	out = append(out, rest.Bytes()...)
+	if !bytes.Equal(a, out) {
+		t.Error("read back", len(out), "bytes not matching original")
+	}
+	if n, err := d.Read(make([]byte, 10)); n != 0 || err != io.EOF {
+		t.Error("expected EOF at end of stream, got", n, err)
+	}
+	d.Close()
+	if _, err := d.Read(make([]byte, 10)); err == nil {
+		t.Error("expected error reading after Close")
+	}
+}
+
+// Tests that DecompressorOptions limits are enforced
+func TestLimits(t *testing.T) {
+	in := stream(-3, "abc", 30, -3, -3, "abc", 0, -3, "abc", 0, 0)
+	tests := []struct {
+		opts DecompressorOptions
+		ok   bool
+	}{
+		{DecompressorOptions{}, true},
+		{DecompressorOptions{MaxOutputBytes: 39, MaxBlockBytes: 36, MaxInstructionLength: 30}, true},
+		{DecompressorOptions{MaxOutputBytes: 38}, false},
+		{DecompressorOptions{MaxBlockBytes: 35}, false},
+		{DecompressorOptions{MaxInstructionLength: 29}, false},
+	}
+	for _, test := range tests {
+		d, err := NewDecompressorOptions(bytes.NewReader(in), 20, nil, true, &test.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = d.WriteTo(io.Discard)
+		if test.ok && err != nil {
+			t.Errorf("with %+v got error %v", test.opts, err)
+		} else if !test.ok && !errors.Is(err, ErrLimitExceeded) {
+			t.Errorf("with %+v got error %v, wanted ErrLimitExceeded", test.opts, err)
+		}
+	}
+	if _, err := NewDecompressorOptions(nil, 27, nil, true, &DecompressorOptions{MaxHistBits: 26}); err != ErrLimitExceeded {
+		t.Error("expected ErrLimitExceeded for too-big history, got", err)
+	}
+}
+
+// Tests writing an index, and starting decompression from an independent block
+func TestIndex(t *testing.T) {
+	// four blocks, each repeating its predecessor, with history reset before the third
+	a := make([]byte, 20000)
+	rndSource, err := rc4.NewCipher([]byte("hello"))
+	if err != nil {
+		t.Error("couldn't set up garbage source")
+	}
+	rndSource.XORKeyStream(a, a)
+	copy(a[5000:], a[:5000])
+	copy(a[15000:], a[10000:15000])
+
+	buf := new(bytes.Buffer)
+	c := NewCompressor(buf, crc())
+	for i := 0; i < 4; i++ {
+		if i == 2 {
+			c.Reset()
+		}
+		c.Write(a[i*5000 : (i+1)*5000])
+		if err = c.Delimit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.Close()
+	x := &Index{Restart: 2, Blocks: c.Blocks()}
+	if len(x.Blocks) != 4 || !x.Blocks[2].Independent || x.Blocks[3].Independent {
+		t.Fatalf("unexpected blocks %+v", x.Blocks)
+	}
+	if _, err = x.WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// read it back and start in the middle
+	r := bytes.NewReader(buf.Bytes())
+	y, err := ReadIndex(r, r.Size())
+	if err != nil {
+		t.Fatal(err)
+	} else if y.Restart != x.Restart || len(y.Blocks) != len(x.Blocks) {
+		t.Fatalf("read back %+v, wanted %+v", y, x)
+	}
+	blk := y.Find(17000)
+	if blk != 2 {
+		t.Fatal("Find returned block", blk, "wanted 2")
+	}
+	b := new(bytes.Buffer)
+	d, err := NewDecompressorAt(r, 0, y, blk, 22, crc(), true, nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err = d.WriteTo(b); err != nil {
+		t.Error(err)
+	} else if !bytes.Equal(b.Bytes(), a[10000:]) {
+		t.Error("decompressed from block 2 does not match original")
+	}
+}
+
+// Tests reading a stream an instruction at a time
+func TestInstrReader(t *testing.T) {
+	read := func(in []byte, opts *DecompressorOptions) (instrs []Instr, err error) {
+		d, _ := NewDecompressorOptions(bytes.NewReader(in), 20, nil, false, opts)
+		x := NewInstrReader(d)
+		for {
+			i, err := x.Next()
+			if err == io.EOF {
+				return instrs, nil
+			} else if err != nil {
+				return instrs, err
+			}
+			instrs = append(instrs, i)
+		}
+	}
+
+	instrs, err := read(stream(-3, "abc", 4, -3, 0, 2, -5, 0, 0), nil)
+	want := []Instr{
+		{Kind: Literal, Offset: 0, Pos: 0, Length: 3},
+		{Kind: Copy, Offset: 4, Pos: 3, Length: 4, CursorMove: -3, From: 0},
+		{Kind: EndOfBlock, Offset: 6, Pos: 7, Length: 7},
+		{Kind: Copy, Offset: 7, Pos: 7, Block: 1, Length: 2, CursorMove: -5, From: 2},
+		{Kind: EndOfBlock, Offset: 9, Pos: 9, Block: 1, Length: 2},
+		{Kind: EndOfBlock, Offset: 10, Pos: 9, Block: 2, Length: 0},
+	}
+	if err != nil || !reflect.DeepEqual(instrs, want) {
+		t.Errorf("got %+v, %v\nwanted %+v", instrs, err, want)
+	}
+
+	instrs, err = read(stream(-7, "\x04abc\x01\x02", 0, 0), &DecompressorOptions{ShortMatches: true})
+	tokens := []Token{{Pos: 0, Length: 3}, {Pos: 3, Length: 4, Distance: 3}}
+	if err != nil || len(instrs) != 3 || !reflect.DeepEqual(instrs[0].Tokens, tokens) {
+		t.Errorf("got %+v, %v; wanted tokens %+v", instrs, err, tokens)
+	}
+
+	// bad input: the instructions before the bad one, then the error
+	instrs, err = read(stream(-3, "abc", 3, -10), nil)
+	if len(instrs) != 1 || !errors.Is(err, errCopyTooFar) {
+		t.Errorf("got %+v, %v; wanted one instruction and %v", instrs, err, errCopyTooFar)
+	}
+}
+
+// builds compressed input by hand: ints become varints, strings are copied as is
+func stream(parts ...interface{}) []byte {
+	var out []byte
+	var buf [binary.MaxVarintLen64]byte
+	for _, p := range parts {
+		switch p := p.(type) {
+		case int:
+			out = append(out, buf[:binary.PutVarint(buf[:], int64(p))]...)
+		case string:
+			out = append(out, p...)
+		}
+	}
+	return out
+}
+
 func TestDecompressBad(t *testing.T) {
-	// copy from too far back
-	// copy from the future
-	// really long copy
-	// really long literal
-	// truncated instruction
-	// truncated literal
-	// truncated copy len
-	// ends after instruction without \0
-	// ends after \0, truncated checksum
-	// ends after \0, missing checksum
-	// ends after \0, bad checksum
-	// ends after \0, but without empty block when concat=true
+	badSum := "\x00\x00\x00\x00"
+	tests := []struct {
+		name   string
+		in     []byte
+		cksum  bool
+		concat bool
+		want   error
+	}{
+		{"copy from too far back", stream(-3, "abc", 3, -10), false, false, errCopyTooFar},
+		{"copy from the future", stream(-3, "abc", 3, 0), false, false, errCopyFuture},
+		{"really long copy", stream(1<<20+1, 0), false, false, errCopyLong},
+		{"really long literal", stream(-(1<<20 + 1)), false, false, errLiteralLong},
+		{"truncated instruction", []byte{0x80}, false, false, io.ErrUnexpectedEOF},
+		{"truncated literal", stream(-5, "ab"), false, false, io.ErrUnexpectedEOF},
+		{"truncated copy len", stream(-3, "abc", 3), false, false, io.ErrUnexpectedEOF},
+		{"ends after instruction without \\0", stream(-3, "abc"), false, false, io.ErrUnexpectedEOF},
+		{"ends after \\0, truncated checksum", stream(-3, "abc", 0, "\x00\x00"), true, false, io.ErrUnexpectedEOF},
+		{"ends after \\0, missing checksum", stream(-3, "abc", 0), true, false, io.ErrUnexpectedEOF},
+		{"ends after \\0, bad checksum", stream(-3, "abc", 0, badSum), true, false, WrongChecksum},
+		{"ends after \\0, but without empty block when concat=true", stream(-3, "abc", 0), false, true, io.ErrUnexpectedEOF},
+	}
+	for _, test := range tests {
+		var h hash.Hash
+		if test.cksum {
+			h = crc()
+		}
+		d := NewDecompressor(bytes.NewReader(test.in), 20, h, test.concat)
+		_, err := d.WriteTo(io.Discard)
+		var corrupt *CorruptInputError
+		if !errors.Is(err, test.want) {
+			t.Errorf("%s: got error %v, wanted %v", test.name, err, test.want)
+		} else if !errors.As(err, &corrupt) {
+			t.Errorf("%s: got %T, wanted a CorruptInputError", test.name, err)
+		}
+	}
+
+	// check the details for one
+	d := NewDecompressor(bytes.NewReader(stream(-3, "abc", 0, -3, "abc", 3, -10)), 20, nil, true)
+	_, err := d.WriteTo(io.Discard)
+	want := CorruptInputError{Offset: 9, Pos: 6, Block: 1, Instr: 3, Err: errCopyTooFar}
+	if corrupt, ok := err.(*CorruptInputError); !ok || *corrupt != want {
+		t.Errorf("got error %#v, wanted %#v", err, want)
+	}
 }
@@ -0,0 +1,131 @@
+package lrcompress
+
+import "errors"
+
+// CompressorOptions tunes the speed/ratio tradeoff. Zero fields get the defaults,
+// which are the same as NewCompressor's. None of these change the format, so
+// decompressors only need to know HistBits. The hashtable, Ways<<TableBits
+// 8-byte entries, can't have more entries than the history has bytes; level 9's
+// uses that many.
+type CompressorOptions struct {
+	HistBits   uint // log2 bytes of history, MinHistBits to MaxHistBits (default 22)
+	TableBits  uint // log2 hashtable buckets, 10 to 30 (default HistBits-4)
+	Ways       int  // candidates kept per bucket, best one used, 1 to 256 (default 1)
+	SampleBits uint // look up/insert 1 in 1<<SampleBits positions, 1 to 12 (default 5)
+	MinMatch   int  // shortest copy to use, 16 to MaxLiteral (default 64)
+	MaxLiteral int  // longest literal to write, up to 1/4 the history (default 1<<16)
+	MaxMatch   int  // longest copy to write, up to the history size (default 1<<18)
+
+	// Code literals as runs and short matches (see format.md). Unlike the other
+	// options, this changes the format: decompressors need ShortMatches set in
+	// their DecompressorOptions too.
+	ShortMatches bool
+
+	// Start each block with a sync marker (see format.md), so Recover can find
+	// blocks after damage. Also changes the format: decompressors need
+	// SyncMarkers set too.
+	SyncMarkers bool
+
+	// Follow each sync marker with a header giving the block's number and whether
+	// it depends on earlier history, and end each block with its length (see
+	// format.md), for ScanIndex. Implies SyncMarkers; decompressors need
+	// BlockHeaders set too.
+	BlockHeaders bool
+}
+
+var defaultOptions = CompressorOptions{
+	HistBits:   CompHistBits,
+	TableBits:  hBits,
+	Ways:       1,
+	SampleBits: fBits,
+	MinMatch:   window,
+	MaxLiteral: maxLiteral,
+	MaxMatch:   maxMatch,
+}
+
+// Compression levels. Lower levels look for matches at fewer positions; higher ones
+// keep more candidates per hashtable bucket (pick the one matching the most bytes)
+// and look more often for shorter matches. The default level is the same as
+// NewCompressor. Level 9 takes about 16x the hashtable RAM of the default.
+const MinLevel, DefaultLevel, MaxLevel = 1, 3, 9
+
+var levels = [MaxLevel + 1]CompressorOptions{
+	1: {SampleBits: 7},
+	2: {SampleBits: 6},
+	3: {},
+	4: {Ways: 2},
+	5: {Ways: 4},
+	6: {Ways: 8},
+	7: {Ways: 8, SampleBits: 4, MinMatch: 48},
+	8: {Ways: 16, SampleBits: 4, MinMatch: 40},
+	9: {Ways: 16, SampleBits: 3, MinMatch: 32},
+}
+
+var (
+	BadLevel   = errors.New("compression level out of range")
+	BadOptions = errors.New("compressor options out of range")
+)
+
+// Whether these options let Write use its constants instead of variables.
+// ShortMatches and SyncMarkers don't matter since they only affect output.
+func (o CompressorOptions) fast() bool {
+	o.ShortMatches, o.SyncMarkers, o.BlockHeaders = false, false, false
+	return o == defaultOptions
+}
+
+// Returns the options for a compression level from MinLevel to MaxLevel, which
+// callers can then adjust (HistBits, say).
+func LevelOptions(level int) (*CompressorOptions, error) {
+	if level < MinLevel || level > MaxLevel {
+		return nil, BadLevel
+	}
+	o := levels[level]
+	return &o, nil
+}
+
+// Fills in defaults and checks the results, including that the decompressor can
+// read what we'd write: literals and copies can't be longer than the history, and
+// literals have to stay in the ring while we're deciding whether to use a match.
+func (opts *CompressorOptions) withDefaults() (o CompressorOptions, err error) {
+	if opts != nil {
+		o = *opts
+	}
+	if o.HistBits == 0 {
+		o.HistBits = defaultOptions.HistBits
+	}
+	if o.HistBits < MinHistBits || o.HistBits > MaxHistBits {
+		return o, BadHistBits
+	}
+	if o.TableBits == 0 {
+		o.TableBits = o.HistBits - (CompHistBits - hBits)
+	}
+	if o.Ways == 0 {
+		o.Ways = defaultOptions.Ways
+	}
+	if o.SampleBits == 0 {
+		o.SampleBits = defaultOptions.SampleBits
+	}
+	if o.MinMatch == 0 {
+		o.MinMatch = defaultOptions.MinMatch
+	}
+	if o.MaxLiteral == 0 {
+		o.MaxLiteral = defaultOptions.MaxLiteral
+	}
+	if o.MaxMatch == 0 {
+		o.MaxMatch = defaultOptions.MaxMatch
+	}
+	if o.BlockHeaders {
+		o.SyncMarkers = true
+	}
+	hist := 1 << o.HistBits
+	if o.TableBits < 10 || o.TableBits > 30 ||
+		o.Ways < 1 || o.Ways > 256 ||
+		o.SampleBits < 1 || o.SampleBits > 12 ||
+		o.MinMatch < 16 || o.MinMatch > o.MaxLiteral ||
+		o.MaxLiteral > hist/4 ||
+		o.MaxMatch < o.MinMatch || o.MaxMatch > hist ||
+		int64(o.Ways)<<o.TableBits > int64(hist) {
+		return o, BadOptions
+	}
+	return o, nil
+}
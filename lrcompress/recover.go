@@ -0,0 +1,343 @@
+package lrcompress
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"io"
+)
+
+// With CompressorOptions.SyncMarkers, each block starts with syncMagic and the
+// uncompressed position it starts at (see format.md). After damage, Recover can
+// then find where the next block starts in both the compressed and uncompressed
+// streams, output zeros in place of what it couldn't read, and carry on. With
+// BlockHeaders, the marker also has the block's number and flags, and each block
+// ends with its length, enough for ScanIndex to index a stream from its headers.
+
+const syncMagic = "\x89HZSYNC\n"
+
+const blockIndependent = 1 // header flag: no copies from before the block
+
+var (
+	errBadSync  = errors.New("bad sync marker")
+	errBlockLen = errors.New("block length doesn't match its end marker")
+)
+var errNoSync = errors.New("Recover needs DecompressorOptions.SyncMarkers")
+var errDataAfterEnd = errors.New("compressed data after the end of the stream")
+
+// Recover's Loss.Err for output copied from an earlier loss.
+var ErrDamagedHistory = errors.New("copied from damaged output")
+
+// Loss is a range of Recover's output that's wrong: zeros standing in for a damaged
+// stretch of the stream (Err is the CorruptInputError Recover hit there), or copies
+// from one (Err is ErrDamagedHistory). Length is -1 if the loss runs to the end of
+// the stream, which Recover couldn't find.
+type Loss struct {
+	Pos    int64
+	Length int64
+	Err    error
+}
+
+// Adds l to sorted, non-overlapping losses, merging it with the last one if they
+// meet and have the same cause.
+func addLoss(losses []Loss, l Loss) []Loss {
+	if k := len(losses) - 1; k >= 0 && losses[k].Err == l.Err && losses[k].Pos+losses[k].Length == l.Pos {
+		losses[k].Length += l.Length
+		return losses
+	}
+	return append(losses, l)
+}
+
+// Whether any of losses overlaps the n bytes starting at from.
+func damaged(losses []Loss, from, n int64) bool {
+	for i := len(losses) - 1; i >= 0; i-- {
+		l := losses[i]
+		if l.Pos+l.Length <= from {
+			return false
+		} else if l.Pos < from+n {
+			return true
+		}
+	}
+	return false
+}
+
+// Where a sync marker seems to be, and what it and any header say.
+type syncPoint struct {
+	offset int64 // compressed
+	pos    int64 // uncompressed
+	block  int64 // with headers
+	flags  byte
+	empty  bool // block ends right away, as at the end of the stream
+}
+
+// Parses a marker and any header at the start of b, returning ok false if b
+// doesn't have one (or ends too soon to tell).
+func parseSyncPoint(b []byte, headers bool) (p syncPoint, ok bool) {
+	if !bytes.HasPrefix(b, []byte(syncMagic)) {
+		return p, false
+	}
+	b = b[len(syncMagic):]
+	next := func() int64 {
+		v, k := binary.Uvarint(b)
+		if k <= 0 {
+			ok = false
+			return 0
+		}
+		b = b[k:]
+		return int64(v)
+	}
+	ok = true
+	if headers {
+		p.block = next()
+	}
+	p.pos = next()
+	if headers && ok && len(b) > 0 {
+		p.flags, b = b[0], b[1:]
+	}
+	if !ok || len(b) == 0 {
+		return p, false
+	}
+	p.empty = b[0] == 0
+	return p, true
+}
+
+// Finds everything that looks like a sync marker in the first size bytes of r.
+// Some may be in literals, or damaged, so callers have to check them somehow.
+func findSyncPoints(r io.ReaderAt, size int64, headers bool) ([]syncPoint, error) {
+	const step = 1 << 20
+	var points []syncPoint
+	buf := make([]byte, step+64) // overlap to catch markers and headers across steps
+	for off := int64(0); off < size; off += step {
+		if off+int64(len(buf)) > size {
+			buf = buf[:size-off]
+		}
+		n, err := r.ReadAt(buf, off)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		b := buf[:n]
+		for i := 0; i < n && i < step; i++ {
+			j := bytes.Index(b[i:], []byte(syncMagic))
+			if j < 0 || i+j >= step {
+				break
+			}
+			i += j
+			if p, ok := parseSyncPoint(b[i:], headers); ok {
+				p.offset = off + int64(i)
+				points = append(points, p)
+			}
+		}
+	}
+	return points, nil
+}
+
+// ScanIndex makes an Index for the first size bytes of r, a stream written with
+// BlockHeaders, from its headers, for streams without one appended. It reads the
+// whole stream, but only to look for headers, so it's much faster than
+// decompressing. sumSize is the size of the checksum the stream uses. Like
+// ReadIndex, it returns BadIndex if it can't make sense of what it finds.
+func ScanIndex(r io.ReaderAt, size int64, sumSize int) (*Index, error) {
+	points, err := findSyncPoints(r, size, true)
+	if err != nil {
+		return nil, err
+	}
+	x := &Index{}
+	var end [1 + binary.MaxVarintLen64]byte
+	for _, p := range points {
+		// a real header has the next block number, and past the first block,
+		// comes right after the last block's end: 0, its length, and the checksum
+		nb := int64(len(x.Blocks))
+		if p.block != nb {
+			continue
+		} else if nb == 0 && p.offset != 0 {
+			continue
+		} else if nb > 0 {
+			prev := x.Blocks[nb-1]
+			if p.pos <= prev.Pos {
+				continue
+			}
+			want := append([]byte{0}, end[1:1+binary.PutUvarint(end[1:], uint64(p.pos-prev.Pos))]...)
+			at := p.offset - int64(sumSize) - int64(len(want))
+			got := end[:len(want)]
+			if at <= prev.Offset {
+				continue
+			} else if _, err := r.ReadAt(got, at); err != nil {
+				return nil, err
+			} else if !bytes.Equal(got, want) {
+				continue
+			}
+		}
+		if p.empty {
+			return x, nil
+		}
+		x.Blocks = append(x.Blocks, BlockInfo{Offset: p.offset, Pos: p.pos, Independent: p.flags&blockIndependent != 0})
+	}
+	return nil, BadIndex
+}
+
+// Whether a stream ending at offset end of the size bytes of r is all there is,
+// but maybe an index appended after it.
+func endsAt(r io.ReaderAt, end, size int64) bool {
+	var footer [12]byte
+	if end == size {
+		return true
+	} else if size-end < int64(len(footer)) {
+		return false
+	} else if _, err := r.ReadAt(footer[:], size-int64(len(footer))); err != nil || string(footer[8:]) != indexSig {
+		return false
+	}
+	return int64(binary.BigEndian.Uint64(footer[:8]))+int64(len(footer)) == size-end
+}
+
+// Recover decompresses a stream written with SyncMarkers from the first size bytes
+// of r to w, carrying on past damage. Where a block is damaged, it tries the
+// markers after it in turn until one starts a block that reads (lookalikes in the
+// data usually don't), then outputs zeros up to the position that block starts at,
+// so the rest of the output lands where it belongs; copies from those zeros are
+// wrong too. While trying, it keeps a second copy of the history. It returns the
+// output ranges that are wrong, and an error only if it couldn't carry on (w
+// failed, say). Other arguments are as for NewDecompressorOptions; opts must have
+// SyncMarkers set. With no checksum, damage that still parses goes unnoticed.
+func Recover(r io.ReaderAt, size int64, w io.Writer, sizeBits uint, h hash.Hash, opts *DecompressorOptions) (losses []Loss, err error) {
+	if opts == nil || !opts.SyncMarkers {
+		return nil, errNoSync
+	}
+	points, err := findSyncPoints(r, size, opts.BlockHeaders)
+	if err != nil {
+		return nil, err
+	}
+	d, err := NewDecompressorOptions(io.NewSectionReader(r, 0, size), sizeBits, h, false, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// losses from copies in the current block, which only count if its checksum
+	// fails, and history a damaged block wrote over, which copies can't use
+	var tainted, clobbered []Loss
+	d.onCopy = func(from, n int64) {
+		bad := damaged(losses, from, n) || damaged(tainted, from, n)
+		for _, c := range clobbered {
+			bad = bad || (c.Pos < from+n && from < c.Pos+c.Length)
+		}
+		if bad {
+			tainted = addLoss(tainted, Loss{Pos: d.pos, Length: n, Err: ErrDamagedHistory})
+		}
+	}
+
+	// Decodes the next block into buf, returning the CorruptInputError if it's
+	// damaged. A checksum failure after copying damaged output doesn't count: the
+	// copies stay in tainted, and the block is finished as if it were fine.
+	var buf bytes.Buffer
+	readBlock := func() error {
+		buf.Reset()
+		tainted = tainted[:0]
+		_, err := d.WriteTo(&buf)
+		if cie, ok := err.(*CorruptInputError); ok && cie.Err == WrongChecksum && len(tainted) > 0 {
+			d.finishBlock()
+			return nil
+		}
+		return err
+	}
+	// Outputs the block readBlock read; done is true at the end of the stream.
+	writeBlock := func() (done bool, err error) {
+		for _, l := range tainted {
+			losses = addLoss(losses, l)
+		}
+		if _, err = buf.WriteTo(w); err != nil || d.blkLen > 0 {
+			return false, err
+		}
+		if !endsAt(r, d.br.n, size) { // the end was a lookalike, or there's junk after it
+			err := &CorruptInputError{Offset: d.br.n, Pos: d.pos, Block: d.block, Err: errDataAfterEnd}
+			losses = append(losses, Loss{Pos: d.pos, Length: -1, Err: err})
+		}
+		return true, nil
+	}
+
+	var backup []byte // the history as a damaged block left it
+	zeros := make([]byte, 1<<16)
+	for {
+		start, offset, outLen := d.pos, d.br.n, d.outLen
+		err := readBlock()
+		if _, ok := err.(*CorruptInputError); err != nil && !ok {
+			return losses, err
+		} else if err == nil {
+			if done, err := writeBlock(); done || err != nil {
+				return losses, err
+			}
+			continue
+		}
+
+		// damaged: find a later marker whose block reads after zeros up to its
+		// position, trying each on the damaged block's history
+		end, hist := d.pos, int64(len(d.ring))
+		if backup == nil {
+			backup = make([]byte, len(d.ring))
+		}
+		copy(backup, d.ring)
+		saved := *d
+		var found *syncPoint
+		for i := range points {
+			p := &points[i]
+			if p.offset <= offset || p.pos < start || (opts.BlockHeaders && p.block <= saved.block) {
+				continue
+			}
+			losses = append(losses, Loss{Pos: start, Length: p.pos - start, Err: err})
+			d.pos, d.outLen = start, outLen+p.pos-start
+			d.litLeft, d.copyLeft, d.codedLeft = 0, 0, 0
+			if skip := p.pos - start - hist; skip > 0 { // only the last hist bytes stay
+				d.pos += skip
+			}
+			for d.pos < p.pos {
+				z := zeros
+				if int64(len(z)) > p.pos-d.pos {
+					z = z[:p.pos-d.pos]
+				}
+				d.Load(z)
+			}
+			// where the damaged block wrote past p.pos, its output replaced history
+			// from before start, unless the zeros did
+			c := Loss{Pos: p.pos - hist, Length: end - p.pos, Err: ErrDamagedHistory}
+			if end > start+hist {
+				c.Length = start + hist - p.pos
+			}
+			n := len(clobbered)
+			if c.Length > 0 {
+				clobbered = append(clobbered, c)
+			}
+			d.finishBlock()
+			if opts.BlockHeaders {
+				d.block = p.block
+			}
+			d.br = &countingReader{br: bufio.NewReader(io.NewSectionReader(r, p.offset, size-p.offset)), n: p.offset}
+
+			terr := readBlock()
+			if _, ok := terr.(*CorruptInputError); terr != nil && !ok {
+				return losses, terr
+			} else if terr == nil && (d.blkLen > 0 || endsAt(r, d.br.n, size)) {
+				found = p
+				break
+			}
+			losses, clobbered = losses[:len(losses)-1], clobbered[:n]
+			*d = saved
+			copy(d.ring, backup)
+		}
+		if found == nil {
+			return append(losses, Loss{Pos: start, Length: -1, Err: err}), nil
+		}
+		for n := found.pos - start; n > 0; {
+			z := zeros
+			if int64(len(z)) > n {
+				z = z[:n]
+			}
+			if _, err = w.Write(z); err != nil {
+				return losses, err
+			}
+			n -= int64(len(z))
+		}
+		if done, err := writeBlock(); done || err != nil {
+			return losses, err
+		}
+	}
+}
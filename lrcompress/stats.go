@@ -0,0 +1,49 @@
+package lrcompress
+
+// Stats counts what a Compressor has done, to help tune it (or pick a history
+// size) for a corpus. Distances and Lengths are histograms with power-of-two
+// buckets: [i] counts copies with a distance or length of at least 1<<(i-1) and
+// under 1<<i. Distance is how far back a copy starts from where it's output.
+type Stats struct {
+	InputBytes      int64 // Written, not counting Load()ed content
+	CompressedBytes int64 // output, including end-of-block markers and checksums
+
+	Literals     int64 // literal instructions
+	LiteralBytes int64
+	Copies       int64 // copy instructions
+	CopyBytes    int64
+	Blocks       int64 // end-of-block markers, including any empty one
+
+	// hashtable activity: positions looked up while in a literal, lookups that
+	// turned up a candidate worth checking, and checks that found a copy
+	Lookups    int64
+	Candidates int64
+	Hits       int64
+
+	// literal bytes coded as short matches, with CompressorOptions.ShortMatches
+	ShortMatches int64
+	ShortBytes   int64
+
+	Distances [64]int64
+	Lengths   [64]int64
+}
+
+// Adds the counts in o to s, to total up several compressors.
+func (s *Stats) Add(o *Stats) {
+	s.InputBytes += o.InputBytes
+	s.CompressedBytes += o.CompressedBytes
+	s.Literals += o.Literals
+	s.LiteralBytes += o.LiteralBytes
+	s.Copies += o.Copies
+	s.CopyBytes += o.CopyBytes
+	s.Blocks += o.Blocks
+	s.Lookups += o.Lookups
+	s.Candidates += o.Candidates
+	s.Hits += o.Hits
+	s.ShortMatches += o.ShortMatches
+	s.ShortBytes += o.ShortBytes
+	for i := range s.Distances {
+		s.Distances[i] += o.Distances[i]
+		s.Lengths[i] += o.Lengths[i]
+	}
+}
@@ -0,0 +1,246 @@
+// Package zipmethod lets archive/zip store entries with lrcompress, so big files
+// with long-range repeats (history dumps, say) get deduplicated inside zips.
+//
+// An entry's data is a byte with its HistBits, a byte of coder flags (framing's
+// Coder values: CoderFlate, CoderShort, CoderSync, and CoderHeaders are allowed),
+// then the lrcompress stream, run through DEFLATE if CoderFlate is set. The stream
+// has no checksums of its own, since zip already keeps a CRC-32 of each entry.
+//
+// Method isn't an ID PKWARE assigned, so only readers that register this package
+// can open such entries. Tools that need a different ID can pass Compressor and
+// Decompressor to zip.Writer's and zip.Reader's RegisterCompressor and
+// RegisterDecompressor themselves.
+package zipmethod
+
+import (
+	"archive/zip"
+	"bufio"
+	"compress/flate"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/twotwotwo/histzip/framing"
+	"github.com/twotwotwo/histzip/lrcompress"
+)
+
+// Method is the zip method ID Register uses ("LR").
+const Method uint16 = 0x4c52
+
+// Coder flags an entry can have; anything else is an error
+const knownCoders = framing.CoderFlate | framing.CoderShort | framing.CoderSync | framing.CoderHeaders
+
+var (
+	BadPrefix     = errors.New("zipmethod: bad entry prefix")
+	UnknownCoders = errors.New("zipmethod: entry uses coders this version can't read")
+)
+
+// Options says how Compressor compresses entries. Entries with a HistBits over 26
+// can only be read where MaxHistBits has been raised.
+type Options struct {
+	Compressor lrcompress.CompressorOptions // zero fields get lrcompress's defaults
+	Flate      bool                         // run the lrcompress data through DEFLATE too; helps on text
+	FlateLevel int                          // for Flate (0 for flate.DefaultCompression)
+}
+
+// Decompressors refuse entries needing over this many bits of history (64 MB,
+// like histzip's -maxhist default) with lrcompress.ErrLimitExceeded, so an entry's
+// first byte can't make them allocate a 1 GB ring. Programs that trust their zips
+// can raise it, up to lrcompress.MaxHistBits, before opening entries.
+var MaxHistBits uint = 26
+
+var register sync.Once
+
+// Register registers Method with archive/zip using the default Options, for all
+// zip.Writers and zip.Readers. It's safe to call more than once.
+func Register() {
+	register.Do(func() {
+		zip.RegisterCompressor(Method, Compressor(nil))
+		zip.RegisterDecompressor(Method, Decompressor)
+	})
+}
+
+// Compressor returns a zip.Compressor for opts (nil means the defaults). Options
+// out of range make it return lrcompress's or flate's error, which zip.Writer's
+// CreateHeader passes on.
+func Compressor(opts *Options) zip.Compressor {
+	o := Options{}
+	if opts != nil {
+		o = *opts
+	}
+	return func(w io.Writer) (io.WriteCloser, error) {
+		return newWriter(w, &o)
+	}
+}
+
+// Compresses one entry.
+type writer struct {
+	w      io.Writer // for the prefix
+	prefix []byte    // still to write; zip.Writer writes the entry header after making us
+	bw     *bufio.Writer
+	fw     *flate.Writer
+	c      *lrcompress.Compressor
+	n      int64 // input in the current block
+}
+
+func newWriter(w io.Writer, o *Options) (*writer, error) {
+	zw := &writer{w: w}
+	out := w
+	var coder byte
+	if o.Flate {
+		level := o.FlateLevel
+		if level == 0 {
+			level = flate.DefaultCompression
+		}
+		fw, err := flate.NewWriter(w, level)
+		if err != nil {
+			return nil, err
+		}
+		zw.fw, out = fw, fw
+		coder |= framing.CoderFlate
+	}
+	zw.bw = bufio.NewWriter(out)
+	c, err := lrcompress.NewCompressorOptions(zw.bw, nil, &o.Compressor)
+	if err != nil {
+		return nil, err
+	}
+	zw.c = c
+	if o.Compressor.ShortMatches {
+		coder |= framing.CoderShort
+	}
+	if o.Compressor.SyncMarkers || o.Compressor.BlockHeaders {
+		coder |= framing.CoderSync
+	}
+	if o.Compressor.BlockHeaders {
+		coder |= framing.CoderHeaders
+	}
+	zw.prefix = []byte{byte(c.HistBits()), coder}
+	return zw, nil
+}
+
+// Writes the prefix if it hasn't been yet. Nothing has gone through flate before
+// this, so the prefix comes first.
+func (zw *writer) start() error {
+	if zw.prefix == nil {
+		return nil
+	}
+	_, err := zw.w.Write(zw.prefix)
+	zw.prefix = nil
+	return err
+}
+
+// Blocks are cut every this many bytes, as in histzip, so decompressors' block
+// limits and sync markers work the same way.
+const blockSize = 1 << 26
+
+func (zw *writer) Write(p []byte) (n int, err error) {
+	if err = zw.start(); err != nil {
+		return 0, err
+	}
+	for len(p) > 0 {
+		chunk := p
+		if room := blockSize - zw.n; int64(len(chunk)) > room {
+			chunk = chunk[:room]
+		}
+		k, err := zw.c.Write(chunk)
+		n, zw.n = n+k, zw.n+int64(k)
+		if err != nil {
+			return n, err
+		}
+		if zw.n == blockSize {
+			if err = zw.c.Delimit(); err != nil {
+				return n, err
+			}
+			zw.n = 0
+		}
+		p = p[k:]
+	}
+	return n, nil
+}
+
+// Close ends the stream and flushes it, but leaves the zip.Writer's writer open.
+func (zw *writer) Close() error {
+	if err := zw.start(); err != nil {
+		return err
+	}
+	if zw.n > 0 {
+		if err := zw.c.Delimit(); err != nil {
+			return err
+		}
+	}
+	if err := zw.c.Close(); err != nil { // the empty block that ends the stream
+		return err
+	} else if err = zw.bw.Flush(); err != nil {
+		return err
+	}
+	if zw.fw != nil {
+		return zw.fw.Close()
+	}
+	return nil
+}
+
+// Decompressor is a zip.Decompressor for entries written by Compressor. It checks
+// the entry's prefix on the first Read.
+func Decompressor(r io.Reader) io.ReadCloser {
+	return &reader{r: r}
+}
+
+// Decompresses one entry.
+type reader struct {
+	r   io.Reader
+	fr  io.ReadCloser
+	d   *lrcompress.Decompressor
+	err error // sticky, from reading the prefix
+}
+
+// Reads the prefix and sets up the decompressor.
+func (zr *reader) start() error {
+	var prefix [2]byte
+	if _, err := io.ReadFull(zr.r, prefix[:]); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return BadPrefix
+	} else if err != nil {
+		return err
+	}
+	bits, coder := uint(prefix[0]), prefix[1]
+	if bits < lrcompress.MinHistBits || bits > lrcompress.MaxHistBits {
+		return BadPrefix
+	} else if coder&^knownCoders != 0 {
+		return UnknownCoders
+	} else if coder&framing.CoderHeaders != 0 && coder&framing.CoderSync == 0 {
+		return BadPrefix
+	}
+	r := zr.r
+	if coder&framing.CoderFlate != 0 {
+		zr.fr = flate.NewReader(r)
+		r = zr.fr
+	}
+	opts := &lrcompress.DecompressorOptions{
+		MaxHistBits:  MaxHistBits,
+		ShortMatches: coder&framing.CoderShort != 0,
+		SyncMarkers:  coder&framing.CoderSync != 0,
+		BlockHeaders: coder&framing.CoderHeaders != 0,
+	}
+	d, err := lrcompress.NewDecompressorOptions(r, bits, nil, true, opts)
+	if err != nil {
+		return err
+	}
+	zr.d = d
+	return nil
+}
+
+func (zr *reader) Read(p []byte) (int, error) {
+	if zr.d == nil && zr.err == nil {
+		zr.err = zr.start()
+	}
+	if zr.err != nil {
+		return 0, zr.err
+	}
+	return zr.d.Read(p)
+}
+
+func (zr *reader) Close() error {
+	if zr.fr != nil {
+		return zr.fr.Close()
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package zipmethod
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+
+	"github.com/twotwotwo/histzip/lrcompress"
+)
+
+func TestRoundTrip(t *testing.T) {
+	// 256 KB of random bytes, repeated 1 MB apart: flate can't see the repeats
+	r := rand.New(rand.NewSource(1))
+	chunk := make([]byte, 1<<18)
+	r.Read(chunk)
+	var data []byte
+	for i := 0; i < 4; i++ {
+		data = append(data, chunk...)
+		filler := make([]byte, 3<<18)
+		r.Read(filler)
+		data = append(data, filler...)
+	}
+	data = append(data, chunk...)
+
+	for _, opts := range []*Options{
+		nil,
+		{Compressor: lrcompress.CompressorOptions{HistBits: 21, ShortMatches: true}, Flate: true},
+		{Compressor: lrcompress.CompressorOptions{BlockHeaders: true}, Flate: true, FlateLevel: 1},
+	} {
+		var buf bytes.Buffer
+		zw := zip.NewWriter(&buf)
+		zw.RegisterCompressor(Method, Compressor(opts))
+		for _, name := range []string{"data", "empty"} {
+			w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: Method})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if name == "data" {
+				if _, err = w.Write(data); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		zr.RegisterDecompressor(Method, Decompressor)
+		for _, f := range zr.File {
+			rc, err := f.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ioutil.ReadAll(rc) // zip checks the CRC at EOF
+			if err != nil {
+				t.Fatal(opts, f.Name, err)
+			}
+			rc.Close()
+			want := data
+			if f.Name == "empty" {
+				want = nil
+			}
+			if !bytes.Equal(got, want) {
+				t.Error(opts, f.Name, "didn't round-trip")
+			}
+			if f.Name == "data" && f.CompressedSize64 > uint64(len(data))*4/5 {
+				t.Error(opts, "compressed to", f.CompressedSize64, "of", len(data))
+			}
+		}
+	}
+}
+
+func TestBadPrefix(t *testing.T) {
+	for in, want := range map[string]error{
+		"":         BadPrefix,
+		"\x16":     BadPrefix,
+		"\x08\x00": BadPrefix,
+		"\x16\x04": UnknownCoders,
+		"\x16\x20": BadPrefix,
+		"\x1f\x00": BadPrefix,
+		"\x1b\x00": lrcompress.ErrLimitExceeded,
+	} {
+		if _, err := ioutil.ReadAll(Decompressor(bytes.NewReader([]byte(in)))); err != want {
+			t.Errorf("prefix %q: got %v, want %v", in, err, want)
+		}
+	}
+}
+
+func TestRegister(t *testing.T) {
+	Register()
+	Register()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: "x", Method: Method})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("hello, hello, hello"))
+	zw.Close()
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, err := zr.File[0].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ioutil.ReadAll(rc); err != nil || string(got) != "hello, hello, hello" {
+		t.Error("got", string(got), err)
+	}
+}
@@ -0,0 +1,33 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+// Without mmap, reads the first size bytes of f into memory (or, if writable,
+// makes room for them); unmapFile writes them back.
+func mapFile(f *os.File, size int64, writable bool) ([]byte, error) {
+	if int64(int(size)) != size {
+		return nil, errors.New("file is too big to read into memory")
+	}
+	b := make([]byte, size)
+	if writable {
+		return b, nil
+	}
+	if _, err := f.ReadAt(b, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return b, nil
+}
+
+func unmapFile(f *os.File, b []byte, writable bool) error {
+	if !writable {
+		return nil
+	}
+	_, err := f.WriteAt(b, 0)
+	return err
+}
@@ -0,0 +1,33 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// Maps the first size bytes of f into memory, read-write if writable (then f has
+// to be open for writing and at least size bytes long). Returns nil for size 0,
+// which can't be mapped.
+func mapFile(f *os.File, size int64, writable bool) ([]byte, error) {
+	if size == 0 {
+		return nil, nil
+	} else if int64(int(size)) != size {
+		return nil, errors.New("file is too big to map into memory")
+	}
+	prot := syscall.PROT_READ
+	if writable {
+		prot |= syscall.PROT_WRITE
+	}
+	return syscall.Mmap(int(f.Fd()), 0, int(size), prot, syscall.MAP_SHARED)
+}
+
+// Undoes mapFile. Changes to a writable mapping are in f afterwards.
+func unmapFile(f *os.File, b []byte, writable bool) error {
+	if b == nil {
+		return nil
+	}
+	return syscall.Munmap(b)
+}
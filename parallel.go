@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"runtime"
+
+	"github.com/twotwotwo/histzip/framing"
+	"github.com/twotwotwo/histzip/lrcompress"
+)
+
+// With -restart K, history starts fresh every K blocks, so each run of K blocks (a
+// segment) can be compressed, checked, and decompressed on its own, and we can
+// use all the cores. Each worker holds a segment's input and output in RAM, about
+// 2*K*64 MB.
+
+// A segment handed to a worker. done is closed when out, blocks, and err are set.
+type segment struct {
+	in          []byte
+	out         bytes.Buffer
+	blocks      []lrcompress.BlockInfo
+	stats       lrcompress.Stats // when compressing, for -v
+	first, last int              // block numbers, when decompressing
+	err         error
+	done        chan struct{}
+}
+
+// Errors out if what's written doesn't match want.
+type compareWriter struct {
+	want []byte
+}
+
+func (cw *compareWriter) Write(p []byte) (int, error) {
+	if len(p) > len(cw.want) || !bytes.Equal(p, cw.want[:len(p)]) {
+		return 0, errors.New("output doesn't match input")
+	}
+	cw.want = cw.want[len(p):]
+	return len(p), nil
+}
+
+// Compresses s.in with fresh history of 1<<bits bytes, then test-decompresses it.
+func (s *segment) compress(bits uint) {
+	c, err := lrcompress.NewCompressorOptions(&s.out, newHash(checksumID), compressorOptions(bits))
+	if err != nil {
+		s.err = err
+		return
+	}
+	for in := s.in; len(in) > 0; {
+		n := len(in)
+		if n > ChunkSize {
+			n = ChunkSize
+		}
+		c.Write(in[:n]) // bytes.Buffer writes don't fail
+		c.Delimit()
+		in = in[n:]
+	}
+	s.blocks, s.stats = c.Blocks(), c.Stats()
+
+	d, err := lrcompress.NewDecompressorOptions(bytes.NewReader(s.out.Bytes()), bits, newHash(checksumID), false, selfTestOptions())
+	if err != nil {
+		s.err = err
+		return
+	}
+	check := &compareWriter{want: s.in}
+	for range s.blocks {
+		if _, err := d.WriteTo(check); err != nil {
+			s.err = fmt.Errorf("test decompression error: %v", err)
+			return
+		}
+	}
+	if len(check.want) > 0 {
+		s.err = errors.New("test decompression error: output too short")
+	}
+}
+
+// Decompresses blocks s.first through s.last-1 of in.
+func (s *segment) decompress(in *os.File, h *framing.Header, x *lrcompress.Index) {
+	d, err := lrcompress.NewDecompressorAt(in, h.Len, x, s.first, h.HistBits, newHash(h.Checksum), false, limits(h))
+	if err != nil {
+		s.err = err
+		return
+	}
+	read := x.Blocks[s.first].Offset // ReadAt bypasses -P's input counting, so report it here
+	d.OnProgress(1<<20, func(in, out int64) {
+		prog.addIn(in - read)
+		read = in
+	})
+	for i := s.first; i < s.last && s.err == nil; i++ {
+		_, s.err = d.WriteTo(&s.out)
+	}
+}
+
+// Runs work on each segment from segs on GOMAXPROCS workers, and returns a channel
+// of the same segments in order, so the caller can wait on each one's done. A
+// caller that gives up early closes quit, so nothing is left blocked sending.
+func runWorkers(segs <-chan *segment, work func(*segment), quit <-chan struct{}) <-chan *segment {
+	workers := runtime.GOMAXPROCS(0)
+	todo := make(chan *segment)
+	inOrder := make(chan *segment, workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for s := range todo {
+				work(s)
+				close(s.done)
+			}
+		}()
+	}
+	go func() {
+		defer close(inOrder)
+		defer close(todo)
+		for s := range segs {
+			select {
+			case inOrder <- s:
+			case <-quit:
+				return
+			}
+			select {
+			case todo <- s:
+			case <-quit:
+				return
+			}
+		}
+	}()
+	return inOrder
+}
+
+// Compresses br to w a segment at a time in parallel, with 1<<bits of history, and
+// writes the end-of-stream marker. Returns the blocks for the index.
+func compressParallel(br io.Reader, w io.Writer, bits uint) (blocks []lrcompress.BlockInfo, err error) {
+	quit := make(chan struct{})
+	defer close(quit)
+	segs := make(chan *segment)
+	readErr := make(chan error, 1)
+	go func() {
+		defer close(segs)
+		for {
+			in, err := ioutil.ReadAll(io.LimitReader(br, int64(*restartFlag)*ChunkSize))
+			if err != nil {
+				readErr <- err
+				return
+			} else if len(in) == 0 {
+				readErr <- nil
+				return
+			}
+			select {
+			case segs <- &segment{in: in, done: make(chan struct{})}:
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	var offset, pos int64
+	for s := range runWorkers(segs, func(s *segment) { s.compress(bits) }, quit) {
+		<-s.done
+		if s.err != nil {
+			return nil, s.err
+		}
+		for _, b := range s.blocks {
+			b.Offset += offset
+			b.Pos += pos
+			blocks = append(blocks, b)
+		}
+		if _, err = w.Write(s.out.Bytes()); err != nil {
+			return nil, err
+		}
+		offset += int64(s.out.Len())
+		pos += int64(len(s.in))
+		stats.Add(&s.stats)
+	}
+	if err = <-readErr; err != nil {
+		return nil, err
+	}
+	// an empty block ends the stream
+	c := lrcompress.NewCompressor(w, newHash(checksumID))
+	err = c.Close()
+	end := c.Stats()
+	stats.Add(&end)
+	statsHistBits = bits
+	return blocks, err
+}
+
+// Decompresses in to w, handing the runs of blocks between independent blocks to
+// parallel workers.
+func decompressParallel(in *os.File, h *framing.Header, x *lrcompress.Index, w io.Writer) error {
+	if len(x.Blocks) > 0 && !x.Blocks[0].Independent {
+		return errors.New("index doesn't start with an independent block")
+	}
+	quit := make(chan struct{})
+	defer close(quit)
+	segs := make(chan *segment)
+	go func() {
+		defer close(segs)
+		for first := 0; first < len(x.Blocks); {
+			last := first + 1
+			for last < len(x.Blocks) && !x.Blocks[last].Independent {
+				last++
+			}
+			select {
+			case segs <- &segment{first: first, last: last, done: make(chan struct{})}:
+			case <-quit:
+				return
+			}
+			first = last
+		}
+	}()
+
+	var written int64
+	for s := range runWorkers(segs, func(s *segment) { s.decompress(in, h, x) }, quit) {
+		<-s.done
+		if s.err != nil {
+			return s.err
+		}
+		// each worker enforces the limits, but the total's on us
+		if written += int64(s.out.Len()); *maxOutFlag > 0 && written > *maxOutFlag {
+			return lrcompress.ErrLimitExceeded
+		}
+		if _, err := s.out.WriteTo(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// With -P, histzip counts bytes as they go in and out and prints a progress line
+// to stderr once a second, with an ETA when the input's size is known. Input is
+// counted under the bufio.Reader and output at the writer process() hands down;
+// code that reads or writes around those (ReadAt, mapped files) reports for itself.
+
+// progress for the file being processed, or nil without -P
+var prog *progress
+
+type progress struct {
+	in, out int64 // bytes so far, updated atomically
+	size    int64 // of the input, 0 if unknown
+	start   time.Time
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// Starts printing progress for an input of size bytes (0 if unknown).
+func startProgress(size int64) *progress {
+	p := &progress{size: size, start: time.Now(), stop: make(chan struct{}), done: make(chan struct{})}
+	go func() {
+		defer close(p.done)
+		t := time.NewTicker(time.Second)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				p.print(false)
+			case <-p.stop:
+				p.print(true)
+				return
+			}
+		}
+	}()
+	return p
+}
+
+// Stops the timer and prints the final line.
+func (p *progress) finish() {
+	close(p.stop)
+	<-p.done
+}
+
+// The methods below do nothing on a nil *progress, so callers needn't check for -P.
+
+func (p *progress) addIn(n int64) {
+	if p != nil {
+		atomic.AddInt64(&p.in, n)
+	}
+}
+
+func (p *progress) addOut(n int64) {
+	if p != nil {
+		atomic.AddInt64(&p.out, n)
+	}
+}
+
+func (p *progress) setIn(n int64) {
+	if p != nil {
+		atomic.StoreInt64(&p.in, n)
+	}
+}
+
+func (p *progress) setOut(n int64) {
+	if p != nil {
+		atomic.StoreInt64(&p.out, n)
+	}
+}
+
+// Prints a line like "histzip: 1.2 GB in, 400.0 MB out (33.3%), 95.1 MB/s, 40% done,
+// ETA 19s", rewriting it in place until the last one.
+func (p *progress) print(last bool) {
+	in, out := atomic.LoadInt64(&p.in), atomic.LoadInt64(&p.out)
+	secs := time.Since(p.start).Seconds()
+	line := fmt.Sprintf("histzip: %s in, %s out (%.1f%%)", byteCount(in), byteCount(out), percent(out, in))
+	if secs > 0 {
+		line += fmt.Sprintf(", %.1f MB/s", float64(in)/secs/1e6)
+	}
+	if p.size > 0 && !last {
+		line += fmt.Sprintf(", %.0f%% done", percent(in, p.size))
+		if in > 0 && in < p.size {
+			eta := time.Duration(secs * float64(p.size-in) / float64(in) * float64(time.Second))
+			line += ", ETA " + eta.Round(time.Second).String()
+		}
+	}
+	end := "   " // covers the tail of a longer previous line
+	if last {
+		end += "\n"
+	}
+	fmt.Fprint(os.Stderr, "\r"+line+end)
+}
+
+// Formats n bytes with one decimal place in the biggest unit under it.
+func byteCount(n int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB", "PB", "EB"}
+	f, i := float64(n), 0
+	for f >= 1000 && i < len(units)-1 {
+		f, i = f/1000, i+1
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d B", n)
+	}
+	return fmt.Sprintf("%.1f %s", f, units[i])
+}
+
+// Counts what's read from r as input.
+type progressReader struct{ r io.Reader }
+
+func (pr progressReader) Read(p []byte) (int, error) {
+	n, err := pr.r.Read(p)
+	prog.addIn(int64(n))
+	return n, err
+}
+
+// Counts what's written to w as output.
+type progressWriter struct{ w io.Writer }
+
+func (pw progressWriter) Write(p []byte) (int, error) {
+	n, err := pw.w.Write(p)
+	prog.addOut(int64(n))
+	return n, err
+}
+
+// Returns w without -P's counting, for code that writes around w (to a mapped file,
+// say) and reports its output itself.
+func uncounted(w io.Writer) io.Writer {
+	if pw, ok := w.(progressWriter); ok {
+		return pw.w
+	}
+	return w
+}
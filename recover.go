@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/twotwotwo/histzip/framing"
+	"github.com/twotwotwo/histzip/lrcompress"
+)
+
+// With -recover, decompressing a file written with -sync carries on past damage:
+// lrcompress.Recover skips ahead to the next block it can read, writing zeros in
+// place of what it couldn't, and histzip reports what was lost on stderr. The
+// output is kept (and so is the input), but histzip exits with status 2.
+
+// whether -recover found damage in any input, for the exit status
+var recoveredDamage bool
+
+// Decompresses the lrcompress data in in after header h to w with
+// lrcompress.Recover, and reports any damage. br is just past the header.
+func recoverOutput(in *os.File, br *bufio.Reader, h *framing.Header, w io.Writer) error {
+	if h.Coder&framing.CoderSync == 0 {
+		return errors.New("-recover needs a file compressed with -sync")
+	} else if h.Coder&(framing.CoderFlate|framing.CoderFar|framing.CoderFlat) != 0 {
+		return errors.New("-recover can't read files compressed with -z, -far, or -mmap")
+	}
+
+	// Recover needs to jump around, so it needs a file: in, or a temp file with
+	// the rest of br
+	var ra io.ReaderAt
+	var start, size int64
+	if info, err := in.Stat(); err == nil && info.Mode().IsRegular() {
+		if start, err = in.Seek(0, io.SeekCurrent); err != nil {
+			return err
+		}
+		start -= int64(br.Buffered()) // br has read ahead
+		ra, size = in, info.Size()-start
+	} else {
+		tmp, err := ioutil.TempFile("", "histzip")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+		if size, err = io.Copy(tmp, br); err != nil {
+			return err
+		}
+		ra = tmp
+	}
+
+	bw := bufio.NewWriter(w)
+	losses, err := lrcompress.Recover(io.NewSectionReader(ra, start, size), size, bw, h.HistBits, newHash(h.Checksum), limits(h))
+	if err != nil {
+		return err
+	} else if err = bw.Flush(); err != nil {
+		return err
+	}
+	for _, l := range losses {
+		if l.Length < 0 {
+			fmt.Fprintf(os.Stderr, "histzip: lost everything from byte %d on: %v\n", l.Pos, l.Err)
+		} else {
+			fmt.Fprintf(os.Stderr, "histzip: lost bytes %d to %d: %v\n", l.Pos, l.Pos+l.Length, l.Err)
+		}
+	}
+	if len(losses) > 0 {
+		recoveredDamage = true
+	}
+	return nil
+}
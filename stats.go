@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/twotwotwo/histzip/lrcompress"
+)
+
+// With -v, histzip totals up its compressors' Stats and prints them at exit, to
+// help tell whether a corpus would benefit from more history, another level, etc.
+var stats lrcompress.Stats
+var statsHistBits uint // history the stats are for, 0 with -mmap
+
+// Formats 1<<bits bytes.
+func sizeName(bits int) string {
+	units := []string{"B", "KB", "MB", "GB", "TB", "PB", "EB"}
+	return fmt.Sprintf("%d %s", 1<<uint(bits%10), units[bits/10])
+}
+
+// percent of b that a is
+func percent(a, b int64) float64 {
+	if b == 0 {
+		return 0
+	}
+	return 100 * float64(a) / float64(b)
+}
+
+// Prints a power-of-two histogram from Stats, skipping empty buckets.
+func printHistogram(w io.Writer, title string, buckets []int64) {
+	fmt.Fprintf(w, "  copies by %s:\n", title)
+	for i, n := range buckets {
+		if n == 0 {
+			continue
+		}
+		lo := "0"
+		if i > 0 {
+			lo = sizeName(i - 1)
+		}
+		fmt.Fprintf(w, "    %8s to %-8s %12d\n", lo, sizeName(i), n)
+	}
+}
+
+// Prints s, the totals for compressing with 1<<histBits of history (0 for -mmap's
+// whole-file history).
+func printStats(w io.Writer, s *lrcompress.Stats, histBits uint) {
+	fmt.Fprintf(w, "histzip: %d bytes in, %d bytes of lrcompress data out (%.1f%%), %d blocks\n",
+		s.InputBytes, s.CompressedBytes, percent(s.CompressedBytes, s.InputBytes), s.Blocks)
+	fmt.Fprintf(w, "  literals:  %12d, %12d bytes (%.1f%% of input)\n", s.Literals, s.LiteralBytes, percent(s.LiteralBytes, s.InputBytes))
+	fmt.Fprintf(w, "  copies:    %12d, %12d bytes (%.1f%% of input)\n", s.Copies, s.CopyBytes, percent(s.CopyBytes, s.InputBytes))
+	if s.ShortMatches > 0 {
+		fmt.Fprintf(w, "  short matches in literals: %d, %d bytes (%.1f%% of literal bytes)\n", s.ShortMatches, s.ShortBytes, percent(s.ShortBytes, s.LiteralBytes))
+	}
+	fmt.Fprintf(w, "  hashtable: %d lookups, %d candidates checked, %d hits (%.2f%% of lookups)\n", s.Lookups, s.Candidates, s.Hits, percent(s.Hits, s.Lookups))
+	printHistogram(w, "distance back", s.Distances[:])
+	printHistogram(w, "length", s.Lengths[:])
+	if histBits > 0 && s.Copies > 0 {
+		// [histBits] holds distances in the older half of the history
+		far := s.Distances[histBits]
+		fmt.Fprintf(w, "  %.1f%% of copies reach into the older half of the %s history", percent(far, s.Copies), sizeName(int(histBits)))
+		if percent(far, s.Copies) >= 10 {
+			fmt.Fprint(w, "; more history (or -far, or -mmap) would likely help")
+		}
+		fmt.Fprintln(w)
+	}
+}
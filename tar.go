@@ -0,0 +1,319 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/twotwotwo/histzip/framing"
+	"github.com/twotwotwo/histzip/lrcompress"
+)
+
+// With -tar, histzip reads the input as a tar with archive/tar and, before
+// compressing, reorders it in groups of members up to -tarbuf bytes: each group's
+// headers go first, then its members' contents, so headers don't break up runs of
+// content. -tarsort also sorts each group's contents by name and size, so versions
+// of the same file land next to each other, in the history's reach. The segments
+// are raw bytes of the tar, and each group says where they came from (see
+// format.md), so decompressing puts back the original byte for byte. Whatever
+// archive/tar can't parse (a damaged tail, or input that isn't a tar at all) is
+// passed through in order.
+
+const maxTarGroup = 1 << 30    // -tarbuf's limit
+const tarHeadSlack = 2 << 20   // a group can pass -tarbuf by up to a member's headers
+const maxTarSegments = 1 << 16 // segments in one group, two per member
+const tarPassChunk = 1 << 20   // input passed through in place, a group at a time
+
+var (
+	errBadTarStream = errors.New("bad -tar reordering data")
+	errTarGroupBig  = errors.New("-tar group bigger than -tarbuf allows; decompress with a bigger -tarbuf")
+)
+
+// Passes reads through, keeping a copy of what's been read since the last take.
+type tarRecorder struct {
+	r   io.Reader
+	buf bytes.Buffer
+	off bool // just pass reads through
+}
+
+func (rec *tarRecorder) Read(p []byte) (int, error) {
+	n, err := rec.r.Read(p)
+	if !rec.off {
+		rec.buf.Write(p[:n])
+	}
+	return n, err
+}
+
+// Returns what's been read since the last take.
+func (rec *tarRecorder) take() []byte {
+	b := append([]byte(nil), rec.buf.Bytes()...)
+	rec.buf.Reset()
+	return b
+}
+
+// One member, as raw bytes of the tar: any padding after the member before it plus
+// its headers, then its content.
+type tarMember struct {
+	name       string
+	head, data []byte
+}
+
+// Writes a group's table and segments: stored holds each segment's index in the
+// original order, and segs the segments in stored order.
+func writeTarGroup(w *bufio.Writer, stored []int, segs [][]byte) error {
+	var buf [binary.MaxVarintLen64]byte
+	w.Write(buf[:binary.PutUvarint(buf[:], uint64(len(segs)))])
+	for i, seg := range segs {
+		w.Write(buf[:binary.PutUvarint(buf[:], uint64(stored[i]))])
+		w.Write(buf[:binary.PutUvarint(buf[:], uint64(len(seg)))])
+	}
+	for _, seg := range segs {
+		if _, err := w.Write(seg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Writes the reordered stream for the tar r to w, grouping up to limit bytes of
+// members; sortSimilar also sorts their contents by name and size.
+func reorderTar(r io.Reader, w io.Writer, limit int64, sortSimilar bool) error {
+	bw := bufio.NewWriter(w)
+	rec := &tarRecorder{r: r}
+	tr := tar.NewReader(rec)
+	var members []*tarMember
+	var buffered int64
+	chunk := make([]byte, tarPassChunk)
+
+	flush := func() error {
+		if len(members) == 0 {
+			return nil
+		}
+		order := make([]int, len(members))
+		for i := range order {
+			order[i] = i
+		}
+		if sortSimilar {
+			sort.SliceStable(order, func(i, j int) bool {
+				a, b := members[order[i]], members[order[j]]
+				if ka, kb := tarSortKey(a.name), tarSortKey(b.name); ka != kb {
+					return ka < kb
+				}
+				return len(a.data) < len(b.data)
+			})
+		}
+		// member i's head is segment 2i and its content 2i+1
+		stored := make([]int, 0, 2*len(members))
+		segs := make([][]byte, 0, 2*len(members))
+		for i, m := range members {
+			stored, segs = append(stored, 2*i), append(segs, m.head)
+		}
+		for _, i := range order {
+			stored, segs = append(stored, 2*i+1), append(segs, members[i].data)
+		}
+		members, buffered = members[:0], 0
+		return writeTarGroup(bw, stored, segs)
+	}
+
+	for {
+		hdr, err := tr.Next()
+		if err != nil { // the end, or not a tar from here on
+			break
+		}
+		if hdr.Size > limit/2 && (hdr.Typeflag != tar.TypeReg || sparse(hdr)) {
+			// too big to hold, and reading it doesn't give its raw bytes to pass on
+			break
+		}
+		head := rec.take()
+		if hdr.Typeflag == tar.TypeReg && !sparse(hdr) && hdr.Size > limit/2 {
+			// too big to hold: goes through in place, a chunk at a time
+			if err = flush(); err != nil {
+				return err
+			} else if err = writeTarGroup(bw, []int{0}, [][]byte{head}); err != nil {
+				return err
+			}
+			rec.off = true
+			err = passTar(bw, tr, chunk)
+			rec.off = false
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err = io.Copy(ioutil.Discard, tr); err != nil {
+			// truncated or damaged: what we read goes out with the rest
+			data := rec.take()
+			rec.buf.Write(head)
+			rec.buf.Write(data)
+			break
+		}
+		m := &tarMember{name: hdr.Name, head: head, data: rec.take()}
+		if size := int64(len(m.head) + len(m.data)); buffered+size > limit || 2*len(members) == maxTarSegments {
+			if err = flush(); err != nil {
+				return err
+			}
+		}
+		members = append(members, m)
+		buffered += int64(len(m.head) + len(m.data))
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+
+	// pass through the end blocks and anything archive/tar couldn't read, in order
+	if err := passTar(bw, io.MultiReader(bytes.NewReader(rec.take()), rec.r), chunk); err != nil {
+		return err
+	}
+	bw.WriteByte(0) // end
+	return bw.Flush()
+}
+
+// Copies r to w in order, as groups of one segment of up to len(chunk) bytes. A
+// truncated tar member just ends early; what follows it goes through the same way.
+func passTar(w *bufio.Writer, r io.Reader, chunk []byte) error {
+	for {
+		n, err := io.ReadFull(r, chunk)
+		if n > 0 {
+			if err := writeTarGroup(w, []int{0}, [][]byte{chunk[:n]}); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// Whether hdr is a PAX sparse file, whose content in the tar isn't what reading
+// it returns.
+func sparse(hdr *tar.Header) bool {
+	for k := range hdr.PAXRecords {
+		if strings.HasPrefix(k, "GNU.sparse.") {
+			return true
+		}
+	}
+	return false
+}
+
+// What -tarsort groups contents by: the extension, then the base name without it,
+// so dir1/foo.c, dir2/foo.c, and dir1/bar.c sort as bar.c, foo.c, foo.c.
+func tarSortKey(name string) string {
+	ext := path.Ext(name)
+	return ext + "\x00" + strings.TrimSuffix(path.Base(name), ext)
+}
+
+// Reads the reordered stream from r and writes the original tar to w. Groups can
+// hold up to maxGroup bytes plus tarHeadSlack, and together, if maxOut isn't 0,
+// maxOut bytes.
+func restoreTar(r io.Reader, w io.Writer, maxGroup, maxOut int64) error {
+	br := bufio.NewReader(r)
+	bw := bufio.NewWriter(w)
+	readUvarint := func() (uint64, error) {
+		v, err := binary.ReadUvarint(br)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return v, err
+	}
+	var buf []byte
+	var written int64
+	for {
+		limit, limitErr := maxGroup+tarHeadSlack, errTarGroupBig
+		if maxOut > 0 && maxOut-written < limit {
+			limit, limitErr = maxOut-written, lrcompress.ErrLimitExceeded
+		}
+		n, err := readUvarint()
+		if err != nil {
+			return err
+		} else if n == 0 {
+			break
+		} else if n > maxTarSegments {
+			return errBadTarStream
+		}
+		stored := make([]int, n)
+		lens := make([]int64, n)
+		seen := make([]bool, n)
+		identity := true
+		var total int64
+		for i := range stored {
+			idx, err := readUvarint()
+			if err != nil {
+				return err
+			}
+			l, err := readUvarint()
+			if err != nil {
+				return err
+			}
+			if idx >= n || seen[idx] {
+				return errBadTarStream
+			} else if l > uint64(limit-total) {
+				return limitErr
+			}
+			seen[idx] = true
+			stored[i], lens[i] = int(idx), int64(l)
+			identity = identity && int(idx) == i
+			total += int64(l)
+		}
+
+		// in order already (say, part of a member too big to reorder): stream it
+		written += total
+		if identity {
+			if _, err := io.CopyN(bw, br, total); err != nil {
+				return noEOF(err)
+			}
+			continue
+		}
+		if int64(cap(buf)) < total {
+			buf = make([]byte, total)
+		}
+		group := buf[:total]
+		if _, err := io.ReadFull(br, group); err != nil {
+			return noEOF(err)
+		}
+		segs := make([][]byte, n)
+		for i, idx := range stored {
+			segs[idx], group = group[:lens[i]], group[lens[i]:]
+		}
+		for _, seg := range segs {
+			if _, err := bw.Write(seg); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := br.ReadByte(); err != io.EOF {
+		return errors.New("data after end of -tar reordering")
+	}
+	return bw.Flush()
+}
+
+// Compresses the tar in br to w as compress does, reordering it first.
+func compressTar(br *bufio.Reader, w io.Writer, h *framing.Header) error {
+	pr, pw := io.Pipe()
+	defer pr.Close() // unblocks reorderTar if we fail
+	go func() {
+		pw.CloseWithError(reorderTar(br, pw, *tarBufFlag, *tarSortFlag))
+	}()
+	h.Coder |= framing.CoderTar
+	return compress(nil, bufio.NewReader(pr), w, h)
+}
+
+// Decompresses a file compressed with -tar from br, just past in's header h, and
+// writes the original tar to w.
+func decompressTar(in *os.File, br *bufio.Reader, h *framing.Header, w io.Writer) error {
+	pr, pw := io.Pipe()
+	defer pr.Close() // unblocks decompress if we fail
+	go func() {
+		pw.CloseWithError(decompress(in, br, h, pw))
+	}()
+	return restoreTar(pr, w, *tarBufFlag, *maxOutFlag)
+}